@@ -0,0 +1,100 @@
+// Command pgmigrate applies the migrations inside a directory to the postgres
+// database given by the PG_DSN environment variable, using the
+// pgmigrate.DefaultConfig.
+//
+// Usage:
+//
+//	pgmigrate [-dir path] up|status|pending|check
+//
+// The up command applies all pending migrations and prints their ids. The
+// status command prints the state of every migration, and the pending command
+// prints the migrations that have not been applied yet. The check command
+// executes the pending migrations without committing them. All commands exit
+// with a non-zero status if modified or unknown migrations are detected.
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/felixge/pgmigrate"
+	_ "github.com/lib/pq"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "pgmigrate: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// run executes the command given by args and writes its output to out.
+func run(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("pgmigrate", flag.ContinueOnError)
+	dir := flags.String("dir", ".", "directory containing the migration files")
+	allowBreaking := flags.Bool("allow-breaking", false, "apply migrations marked as breaking")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: pgmigrate [-dir path] [-allow-breaking] up|status|pending|check\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	} else if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("expected exactly one command")
+	}
+	ms, err := pgmigrate.LoadMigrationsDir(*dir)
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	c := pgmigrate.DefaultConfig
+	c.AllowBreaking = *allowBreaking
+	switch cmd := flags.Arg(0); cmd {
+	case "up":
+		applied, err := c.Migrate(db, ms)
+		if err != nil {
+			return err
+		}
+		for _, id := range applied.IDs() {
+			fmt.Fprintf(out, "%d\n", id)
+		}
+		return nil
+	case "status":
+		statuses, err := c.Status(db, ms)
+		if err != nil {
+			return err
+		}
+		var drift bool
+		for _, s := range statuses {
+			fmt.Fprintf(out, "%d %s %s\n", s.ID, s.State, s.Description)
+			drift = drift || s.State == pgmigrate.Modified || s.State == pgmigrate.Missing
+		}
+		if drift {
+			return errors.New("modified or unknown migrations detected")
+		}
+		return nil
+	case "pending":
+		pending, err := c.Pending(db, ms)
+		if err != nil {
+			return err
+		}
+		for _, m := range pending {
+			fmt.Fprintf(out, "%d %s\n", m.ID, m.Description)
+		}
+		return nil
+	case "check":
+		return c.Check(db, ms)
+	default:
+		flags.Usage()
+		return fmt.Errorf("unknown command: %s", cmd)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRun_errors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		Args    []string
+		WantErr string
+	}{
+		{nil, "expected exactly one command"},
+		{[]string{"-dir", dir, "up", "status"}, "expected exactly one command"},
+		{[]string{"-dir", dir, "frobnicate"}, "unknown command: frobnicate"},
+		{[]string{"-nope", "up"}, "flag provided but not defined: -nope"},
+		{[]string{"-dir", filepath.Join(dir, "missing"), "up"}, "no such file or directory"},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		err := run(test.Args, &out)
+		if err == nil || !strings.Contains(err.Error(), test.WantErr) {
+			t.Errorf("%q: got=%v want=%q", test.Args, err, test.WantErr)
+		} else if out.Len() != 0 {
+			t.Errorf("%q: unexpected output: %q", test.Args, out.String())
+		}
+	}
+}
+
+func TestRun_roundTrip(t *testing.T) {
+	if os.Getenv("PG_DSN") == "" {
+		t.Skip("PG_DSN is not set")
+	}
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS migrations CASCADE; DROP TABLE IF EXISTS public.pgmigrate_cmd"); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	writeFile := func(name, sql string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(sql), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runCmd := func(cmd string) (string, error) {
+		var out bytes.Buffer
+		err := run([]string{"-dir", dir, cmd}, &out)
+		return out.String(), err
+	}
+	writeFile("1_create.sql", "CREATE TABLE public.pgmigrate_cmd (id int);")
+	writeFile("2_insert.sql", "INSERT INTO public.pgmigrate_cmd VALUES (1);")
+
+	if got, err := runCmd("pending"); err != nil {
+		t.Fatal(err)
+	} else if want := "1 1_create.sql\n2 2_insert.sql\n"; got != want {
+		t.Fatalf("got=%q want=%q", got, want)
+	}
+	if got, err := runCmd("up"); err != nil {
+		t.Fatal(err)
+	} else if want := "1\n2\n"; got != want {
+		t.Fatalf("got=%q want=%q", got, want)
+	}
+	writeFile("3_insert.sql", "INSERT INTO public.pgmigrate_cmd VALUES (3);")
+	if got, err := runCmd("status"); err != nil {
+		t.Fatal(err)
+	} else if want := "1 applied 1_create.sql\n2 applied 2_insert.sql\n3 pending 3_insert.sql\n"; got != want {
+		t.Fatalf("got=%q want=%q", got, want)
+	}
+	if got, err := runCmd("pending"); err != nil {
+		t.Fatal(err)
+	} else if want := "3 3_insert.sql\n"; got != want {
+		t.Fatalf("got=%q want=%q", got, want)
+	}
+
+	writeFile("2_insert.sql", "INSERT INTO public.pgmigrate_cmd VALUES (2);")
+	got, err := runCmd("status")
+	if err == nil || err.Error() != "modified or unknown migrations detected" {
+		t.Fatalf("unexpected error: %v", err)
+	} else if want := "1 applied 1_create.sql\n2 modified 2_insert.sql\n3 pending 3_insert.sql\n"; got != want {
+		t.Fatalf("got=%q want=%q", got, want)
+	}
+	if got, err := runCmd("up"); err == nil {
+		t.Fatalf("expected error, got output %q", got)
+	}
+}
@@ -0,0 +1,157 @@
+package pgmigrate
+
+import (
+	"context"
+	"database/sql"
+)
+
+// DB is the subset of database functionality used by pgmigrate. It allows to
+// use pgmigrate with drivers that don't implement database/sql, e.g. the
+// native interface of github.com/jackc/pgx. Use SQLDB for a *sql.DB.
+type DB interface {
+	Querier
+	// Begin starts a new transaction.
+	Begin(ctx context.Context) (Tx, error)
+	// Conn returns a dedicated connection that is used for holding the
+	// advisory lock that prevents concurrent migrations.
+	Conn(ctx context.Context) (Conn, error)
+}
+
+// Querier executes queries.
+type Querier interface {
+	// Exec executes a query without returning any rows.
+	Exec(ctx context.Context, query string, args ...interface{}) error
+	// Query executes a query that returns rows.
+	Query(ctx context.Context, query string, args ...interface{}) (Rows, error)
+}
+
+// Tx is a transaction started by DB.Begin.
+type Tx interface {
+	Querier
+	// Commit commits the transaction.
+	Commit() error
+	// Rollback aborts the transaction. It's called after Commit, in which
+	// case it may return an error which is ignored.
+	Rollback() error
+}
+
+// Conn is a dedicated connection returned by DB.Conn.
+type Conn interface {
+	Querier
+	// Close returns the connection to the pool.
+	Close() error
+}
+
+// Rows is the result of a query, see sql.Rows.
+type Rows interface {
+	Next() bool
+	Scan(dest ...interface{}) error
+	Close() error
+	Err() error
+}
+
+// SQLDB returns a DB for the given *sql.DB.
+func SQLDB(db *sql.DB) DB {
+	return sqlDB{db}
+}
+
+// sqlDB implements DB for a *sql.DB.
+type sqlDB struct {
+	db *sql.DB
+}
+
+// Exec is part of the Querier interface.
+func (s sqlDB) Exec(ctx context.Context, query string, args ...interface{}) error {
+	_, err := s.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Query is part of the Querier interface.
+func (s sqlDB) Query(ctx context.Context, query string, args ...interface{}) (Rows, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// Begin is part of the DB interface.
+func (s sqlDB) Begin(ctx context.Context) (Tx, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return sqlTx{tx}, nil
+}
+
+// Conn is part of the DB interface.
+func (s sqlDB) Conn(ctx context.Context) (Conn, error) {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return sqlConn{conn}, nil
+}
+
+// SQLTx returns the *sql.Tx of q if q is a transaction started by a DB
+// returned by SQLDB, e.g. for passing it to code that expects a *sql.Tx from
+// a Migration.Func.
+func SQLTx(q Querier) (*sql.Tx, bool) {
+	s, ok := q.(sqlTx)
+	return s.tx, ok
+}
+
+// sqlTx implements Tx for a *sql.Tx.
+type sqlTx struct {
+	tx *sql.Tx
+}
+
+// Exec is part of the Querier interface.
+func (s sqlTx) Exec(ctx context.Context, query string, args ...interface{}) error {
+	_, err := s.tx.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Query is part of the Querier interface.
+func (s sqlTx) Query(ctx context.Context, query string, args ...interface{}) (Rows, error) {
+	rows, err := s.tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// Commit is part of the Tx interface.
+func (s sqlTx) Commit() error {
+	return s.tx.Commit()
+}
+
+// Rollback is part of the Tx interface.
+func (s sqlTx) Rollback() error {
+	return s.tx.Rollback()
+}
+
+// sqlConn implements Conn for a *sql.Conn.
+type sqlConn struct {
+	conn *sql.Conn
+}
+
+// Exec is part of the Querier interface.
+func (s sqlConn) Exec(ctx context.Context, query string, args ...interface{}) error {
+	_, err := s.conn.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Query is part of the Querier interface.
+func (s sqlConn) Query(ctx context.Context, query string, args ...interface{}) (Rows, error) {
+	rows, err := s.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// Close is part of the Conn interface.
+func (s sqlConn) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,50 @@
+package pgmigrate
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// NewMigrationFile creates an empty migration file named
+// {{id}}_{{description}}.sql inside of dir and returns its path or an error.
+// The id is one greater than the highest id of the existing migrations in dir,
+// and the description is converted to lowercase with all characters other
+// than letters and digits replaced by underscores.
+func NewMigrationFile(dir, description string) (string, error) {
+	slug := slugify(description)
+	if slug == "" {
+		return "", errors.New("missing description")
+	}
+	ms, err := LoadMigrationsFS(os.DirFS(dir))
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%d_%s.sql", ms.maxID()+1, slug))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return "", err
+	}
+	return path, file.Close()
+}
+
+// slugify returns s in lowercase with all runs of characters other than ASCII
+// letters and digits replaced by a single underscore.
+func slugify(s string) string {
+	var b strings.Builder
+	underscore := false
+	for _, c := range strings.ToLower(s) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			if underscore && b.Len() > 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(c)
+			underscore = false
+		} else {
+			underscore = true
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,42 @@
+package pgmigrate
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewMigrationFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgmigrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	got, err := NewMigrationFile(dir, "Create Users")
+	if err != nil {
+		t.Fatal(err)
+	} else if want := filepath.Join(dir, "1_create_users.sql"); got != want {
+		t.Fatalf("got=%q want=%q", got, want)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "9_bar.sql"), []byte("SELECT 9"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err = NewMigrationFile(dir, " Add users.email (unique)! ")
+	if err != nil {
+		t.Fatal(err)
+	} else if want := filepath.Join(dir, "10_add_users_email_unique.sql"); got != want {
+		t.Fatalf("got=%q want=%q", got, want)
+	}
+	ms, err := LoadMigrations(http.Dir(dir))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(ms) != 3 || ms[2].Description != "10_add_users_email_unique.sql" {
+		t.Fatalf("unexpected migrations: %#v", ms)
+	}
+	_, err = NewMigrationFile(dir, "!!!")
+	if err := checkErr(err, "missing description"); err != nil {
+		t.Fatal(err)
+	}
+}
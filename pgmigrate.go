@@ -3,87 +3,524 @@
 package pgmigrate
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"math"
 	"net/http"
+	"os"
+	"path"
+	"reflect"
 	"regexp"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
+	"unicode/utf8"
 )
 
 var (
-	nameRegexp = regexp.MustCompile("^([\\d]+).+.sql$")
+	nameRegexp      = regexp.MustCompile("^([\\d]+).+.sql$")
+	directiveRegexp = regexp.MustCompile(`^--\s*pgmigrate:\s*(\S*)\s*(.*)`)
+	varRegexp       = regexp.MustCompile(`\$\$\{|\$\{([^}]*)\}`)
 )
 
+// defaultExtension is the default file name extension of migrations.
+const defaultExtension = ".sql"
+
 // LoadMigrations loads all migration files named {{id}}_{{description}}.sql
-// inside dirFS and returns them or an error. The returned Migrations are
-// guaranteed to be sorted, but no validated.
+// inside dirFS and returns them or an error. Files named
+// {{id}}_{{description}}.down.sql are loaded as the DownSQL of the migration
+// with the same id, which is usually named {{id}}_{{description}}.up.sql. The
+// returned Migrations are guaranteed to be sorted, but no validated.
 func LoadMigrations(dirFS http.FileSystem) (Migrations, error) {
-	dir, err := dirFS.Open(".")
+	return LoadOptions{}.LoadMigrations(dirFS)
+}
+
+// LoadMigrationsMulti is like LoadMigrations, but loads and merges the
+// migrations of multiple directories, e.g. a shared directory and a per
+// service directory. It returns an error if migrations in different
+// directories have the same id. Down migrations need to be in the same
+// directory as their up migration.
+func LoadMigrationsMulti(dirs ...http.FileSystem) (Migrations, error) {
+	return LoadOptions{}.LoadMigrationsMulti(dirs...)
+}
+
+// LoadMigrationsFS is like LoadMigrations, but loads the migration files from
+// fsys. This allows to use an embed.FS without an adapter.
+func LoadMigrationsFS(fsys fs.FS) (Migrations, error) {
+	return LoadOptions{}.LoadMigrationsFS(fsys)
+}
+
+// LoadMigrationsDir is like LoadMigrations, but loads the migration files from
+// the directory at path.
+func LoadMigrationsDir(path string) (Migrations, error) {
+	return LoadOptions{}.LoadMigrationsDir(path)
+}
+
+// LoadMigrationsFSDir is like LoadMigrationsFS, but loads the migration files
+// from dir inside of fsys, e.g. the migrations directory of an embed.FS.
+func LoadMigrationsFSDir(fsys fs.FS, dir string) (Migrations, error) {
+	return LoadOptions{}.LoadMigrationsFSDir(fsys, dir)
+}
+
+// LoadMigrationsFromMap is like LoadMigrations, but loads the migrations from
+// files which maps file names to SQL. This is useful for migrations that are
+// generated programmatically, e.g. in tests.
+func LoadMigrationsFromMap(files map[string]string) (Migrations, error) {
+	return LoadOptions{}.LoadMigrationsFromMap(files)
+}
+
+// LoadMigrationsFromReader is like LoadMigrations, but loads the migrations
+// from a single file, e.g. a schema generated by an ORM. Each migration starts
+// with a marker line such as "-- migration: 1 create_users", which holds its
+// id followed by its description.
+func LoadMigrationsFromReader(r io.Reader) (Migrations, error) {
+	return LoadOptions{}.LoadMigrationsFromReader(r)
+}
+
+// LoadOptions allows to customize loading migrations. Its methods behave like
+// the functions of the same name.
+type LoadOptions struct {
+	// Extension is the file name extension of migration files, e.g.
+	// ".sql.tmpl". Down migrations use ".down" followed by Extension.
+	// Defaults to ".sql".
+	Extension string
+	// Marker is the prefix of the lines that start a new migration for
+	// LoadMigrationsFromReader. Defaults to "-- migration:".
+	Marker string
+	// Exclude holds glob patterns in the syntax of path.Match, e.g.
+	// "*.test.sql". Files whose name matches any of them are not loaded.
+	// Defaults to nil, which loads all files.
+	Exclude []string
+}
+
+// LoadMigrations is like the LoadMigrations function.
+func (o LoadOptions) LoadMigrations(dirFS http.FileSystem) (Migrations, error) {
+	return o.LoadMigrationsMulti(dirFS)
+}
+
+// LoadMigrationsMulti is like the LoadMigrationsMulti function.
+func (o LoadOptions) LoadMigrationsMulti(dirs ...http.FileSystem) (Migrations, error) {
+	var (
+		ms     = Migrations{}
+		dirIDs = map[int64]int{}
+	)
+	for i, dir := range dirs {
+		dirMs, err := o.LoadMigrationsFS(httpFS{dir})
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range dirMs {
+			if j, ok := dirIDs[m.ID]; ok && j != i {
+				return nil, fmt.Errorf("duplicate migration id %d in %s and %s", m.ID, dirName(dirs[j], j), dirName(dir, i))
+			}
+			dirIDs[m.ID] = i
+		}
+		ms = append(ms, dirMs...)
+	}
+	sort.Stable(ms)
+	return ms, nil
+}
+
+// LoadMigrationsFromReader is like the LoadMigrationsFromReader function.
+func (o LoadOptions) LoadMigrationsFromReader(r io.Reader) (Migrations, error) {
+	data, err := io.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
-	files, err := dir.Readdir(0)
+	text, ok := decodeSQL(string(data))
+	if !ok {
+		return nil, errors.New("migrations are not valid UTF-8")
+	}
+	marker := o.Marker
+	if marker == "" {
+		marker = "-- migration:"
+	}
+	var (
+		ms     = Migrations{}
+		header strings.Builder
+	)
+	for i, line := range strings.SplitAfter(text, "\n") {
+		if !strings.HasPrefix(line, marker) {
+			if len(ms) == 0 {
+				header.WriteString(line)
+			} else {
+				ms[len(ms)-1].SQL += line
+			}
+			continue
+		} else if len(ms) == 0 && hasEffectiveSQL(header.String()) {
+			return nil, errors.New("sql before first migration marker")
+		}
+		fields := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(line, marker)), " ", 2)
+		if len(fields) != 2 || strings.TrimSpace(fields[1]) == "" {
+			return nil, fmt.Errorf("bad marker on line %d: %q", i+1, strings.TrimSpace(line))
+		}
+		m := Migration{Description: strings.TrimSpace(fields[1])}
+		if m.ID, err = strconv.ParseInt(fields[0], 10, 64); errors.Is(err, strconv.ErrRange) {
+			return nil, fmt.Errorf("migration id out of range: %s", m.Description)
+		} else if err != nil {
+			return nil, fmt.Errorf("bad id: %s: %w", m.Description, err)
+		}
+		ms = append(ms, m)
+	}
+	if len(ms) == 0 && hasEffectiveSQL(header.String()) {
+		// Most likely the Marker doesn't match the input, which would
+		// otherwise cause all of its migrations to be ignored.
+		return nil, errors.New("sql before first migration marker")
+	}
+	for i := range ms {
+		if err := parseDirectives(&ms[i]); err != nil {
+			return nil, fmt.Errorf("bad directive: %s: %w", ms[i].Description, err)
+		}
+	}
+	sort.Stable(ms)
+	return ms, nil
+}
+
+// extension returns the configured Extension, or the default extension.
+func (o LoadOptions) extension() string {
+	if o.Extension == "" {
+		return defaultExtension
+	}
+	return o.Extension
+}
+
+// nameRegexp returns the regexp that matches migration file names and
+// captures their id.
+func (o LoadOptions) nameRegexp() *regexp.Regexp {
+	if o.extension() == defaultExtension {
+		return nameRegexp
+	}
+	return regexp.MustCompile(`^(\d+).+` + regexp.QuoteMeta(o.extension()) + `$`)
+}
+
+// excluded returns true if name matches one of the Exclude patterns, or an
+// error if a pattern is malformed.
+func (o LoadOptions) excluded(name string) (bool, error) {
+	for _, pattern := range o.Exclude {
+		if ok, err := path.Match(pattern, name); err != nil {
+			return false, fmt.Errorf("bad exclude pattern %q: %w", pattern, err)
+		} else if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// dirName returns the path of dir if it's a http.Dir, or its position in the
+// arguments of LoadMigrationsMulti.
+func dirName(dir http.FileSystem, i int) string {
+	if d, ok := dir.(http.Dir); ok {
+		return string(d)
+	}
+	return fmt.Sprintf("dir %d", i+1)
+}
+
+// LoadMigrationsFS is like the LoadMigrationsFS function.
+func (o LoadOptions) LoadMigrationsFS(fsys fs.FS) (Migrations, error) {
+	re := o.nameRegexp()
+	files, err := fs.ReadDir(fsys, ".")
 	if err != nil {
 		return nil, err
 	}
-	ms := make(Migrations, 0, len(files))
+	sqls := make(map[string]string, len(files))
 	for _, file := range files {
-		m := Migration{Description: file.Name()}
-		match := nameRegexp.FindStringSubmatch(m.Description)
-		if len(match) != 2 {
+		if file.IsDir() || !re.MatchString(file.Name()) {
+			continue
+		} else if data, err := fs.ReadFile(fsys, file.Name()); err != nil {
+			return nil, fmt.Errorf("could not read migration: %s: %w", file.Name(), err)
+		} else {
+			sqls[file.Name()] = string(data)
+		}
+	}
+	return o.LoadMigrationsFromMap(sqls)
+}
+
+// MustLoadMigrationsFS is like LoadMigrationsFS, but panics on error. It's
+// intended for loading embedded migrations when initializing variables.
+func MustLoadMigrationsFS(fsys fs.FS) Migrations {
+	ms, err := LoadMigrationsFS(fsys)
+	if err != nil {
+		panic(fmt.Sprintf("pgmigrate: %s", err))
+	}
+	return ms
+}
+
+// LoadMigrationsDir is like the LoadMigrationsDir function.
+func (o LoadOptions) LoadMigrationsDir(path string) (Migrations, error) {
+	return o.LoadMigrationsFS(os.DirFS(path))
+}
+
+// LoadMigrationsFSDir is like the LoadMigrationsFSDir function.
+func (o LoadOptions) LoadMigrationsFSDir(fsys fs.FS, dir string) (Migrations, error) {
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	return o.LoadMigrationsFS(sub)
+}
+
+// LoadMigrationsFromMap is like the LoadMigrationsFromMap function.
+func (o LoadOptions) LoadMigrationsFromMap(files map[string]string) (Migrations, error) {
+	var (
+		re         = o.nameRegexp()
+		downSuffix = ".down" + o.extension()
+	)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var (
+		ms    = make(Migrations, 0, len(names))
+		downs Migrations
+	)
+	for _, name := range names {
+		m := Migration{Description: name}
+		match := re.FindStringSubmatch(m.Description)
+		excluded, err := o.excluded(name)
+		var ok bool
+		if err != nil {
+			return nil, err
+		} else if len(match) != 2 || excluded {
 			continue
-		} else if _, err := fmt.Sscanf(match[1], "%d", &m.ID); err != nil {
-			return nil, fmt.Errorf("bad id: %s: %s", m.Description, err)
-		} else if data, err := readFile(dirFS, m.Description); err != nil {
-			return nil, fmt.Errorf("could not read migration: %s: %s", m.Description, err)
+		} else if m.SQL, ok = decodeSQL(files[name]); !ok {
+			return nil, fmt.Errorf("migration %s is not valid UTF-8", name)
+		} else if m.ID, err = strconv.ParseInt(match[1], 10, 64); errors.Is(err, strconv.ErrRange) {
+			return nil, fmt.Errorf("migration id out of range: %s", m.Description)
+		} else if err != nil {
+			return nil, fmt.Errorf("bad id: %s: %w", m.Description, err)
+		} else if strings.HasSuffix(m.Description, downSuffix) {
+			downs = append(downs, m)
+		} else if err := parseDirectives(&m); err != nil {
+			return nil, fmt.Errorf("bad directive: %s: %w", m.Description, err)
 		} else {
-			m.SQL = string(data)
 			ms = append(ms, m)
 		}
 	}
-	sort.Sort(ms)
+	sort.Stable(ms)
+	for _, down := range downs {
+		i := sort.Search(len(ms), func(i int) bool { return ms[i].ID >= down.ID })
+		if i == len(ms) || ms[i].ID != down.ID {
+			return nil, fmt.Errorf("down migration without up migration: %s", down.Description)
+		}
+		ms[i].DownSQL = down.SQL
+	}
 	return ms, nil
 }
 
-// readFile returns all data for file in fs, or an error.
-func readFile(fs http.FileSystem, name string) ([]byte, error) {
-	file, err := fs.Open(name)
+// decodeSQL returns sql without a leading UTF-8 byte order mark, which
+// editors on Windows may add, and false if sql is not valid UTF-8.
+func decodeSQL(sql string) (string, bool) {
+	sql = strings.TrimPrefix(sql, "\ufeff")
+	return sql, utf8.ValidString(sql)
+}
+
+// parseDirectives sets the fields of m that are controlled by
+// "-- pgmigrate:<directive>" comments at the top of its SQL, or returns an
+// error if an unknown directive is encountered. The following directives are
+// supported:
+//
+//	-- pgmigrate:no-transaction
+//	-- pgmigrate:allow-modification
+//	-- pgmigrate:tags <tag>,...
+//	-- pgmigrate:min-version <major version>
+//	-- pgmigrate:precheck <query>
+//	-- pgmigrate:breaking
+func parseDirectives(m *Migration) error {
+	for _, line := range strings.Split(m.SQL, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		} else if !strings.HasPrefix(line, "--") {
+			break
+		}
+		match := directiveRegexp.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		switch match[1] {
+		case "":
+			return errors.New("missing directive")
+		case "no-transaction":
+			m.NoTransaction = true
+		case "allow-modification":
+			m.AllowModified = true
+		case "tags":
+			for _, tag := range strings.Split(match[2], ",") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					m.Tags = append(m.Tags, tag)
+				}
+			}
+			if len(m.Tags) == 0 {
+				return errors.New("missing tags")
+			}
+		case "min-version":
+			version, err := strconv.Atoi(strings.TrimSpace(match[2]))
+			if err != nil || version <= 0 {
+				return fmt.Errorf("bad min-version %q", match[2])
+			}
+			m.MinVersion = version
+		case "breaking":
+			m.Breaking = true
+		case "precheck":
+			if m.PrecheckSQL = strings.TrimSpace(match[2]); m.PrecheckSQL == "" {
+				return errors.New("missing precheck sql")
+			}
+		default:
+			return fmt.Errorf("unknown directive %q", match[1])
+		}
+	}
+	return nil
+}
+
+// httpFS adapts a http.FileSystem to the fs.FS interface.
+type httpFS struct {
+	fs http.FileSystem
+}
+
+// Open is part of the fs.FS interface.
+func (h httpFS) Open(name string) (fs.File, error) {
+	file, err := h.fs.Open(name)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
-	return ioutil.ReadAll(file)
+	return httpFile{file}, nil
+}
+
+// httpFile adapts a http.File to the fs.ReadDirFile interface.
+type httpFile struct {
+	http.File
+}
+
+// ReadDir is part of the fs.ReadDirFile interface.
+func (f httpFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	infos, err := f.Readdir(n)
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	return entries, err
 }
 
-// Migration holds a migration
+// Migration holds a migration. When marshaled as JSON, empty SQL and DownSQL
+// fields are omitted, so they can be cleared to keep the output small.
 type Migration struct {
-	ID          int
-	Description string
-	SQL         string
+	ID          int64  `json:"id"`
+	Description string `json:"description"`
+	SQL         string `json:"sql,omitempty"`
+	// DownSQL reverts the changes made by SQL. It is optional and only used
+	// by Rollback.
+	DownSQL string `json:"down_sql,omitempty"`
+	// NoTransaction causes SQL to be executed directly against the db rather
+	// than inside of a transaction, which is required for statements such as
+	// CREATE INDEX CONCURRENTLY. If any pending migration is NoTransaction,
+	// Migrate applies all pending migrations as if TxMode was TxPerMigration.
+	// It's set by LoadMigrations for files containing a
+	// "-- pgmigrate:no-transaction" comment at the top.
+	NoTransaction bool `json:"no_transaction,omitempty"`
+	// AllowModified disables the detection of modifications to SQL after
+	// the migration has been applied, e.g. for migrations whose SQL differs
+	// between branches. Its id and description still have to match. It's
+	// set by LoadMigrations for files containing a
+	// "-- pgmigrate:allow-modification" comment at the top.
+	AllowModified bool `json:"allow_modified,omitempty"`
+	// Tags allow to apply a subset of the pending migrations using
+	// MigrateTagged, e.g. "schema" or "backfill". They are set by
+	// LoadMigrations for files containing a comment such as
+	// "-- pgmigrate:tags schema,backfill" at the top.
+	Tags []string `json:"tags,omitempty"`
+	// MinVersion is the major postgres version the migration requires, e.g.
+	// 15, or 0 for any version. Migrate returns an error before executing any
+	// migration if the server is older. It's set by LoadMigrations for files
+	// containing a comment such as "-- pgmigrate:min-version 15" at the top.
+	MinVersion int `json:"min_version,omitempty"`
+	// PrecheckSQL is a query returning a single boolean that is executed
+	// before the migration, e.g. "SELECT count(*) < 1000 FROM users" for
+	// choosing between two backfill strategies. If it returns false, the
+	// migration is skipped, but recorded as applied like any other
+	// migration, so it's never applied later, even if the condition changes.
+	// It's set by LoadMigrations for files containing a comment such as
+	// "-- pgmigrate:precheck SELECT ..." at the top. Changing the comment
+	// modifies the migration.
+	PrecheckSQL string `json:"precheck_sql,omitempty"`
+	// Breaking marks a migration that requires approval before it's
+	// applied, e.g. because it drops a column that is still used by the
+	// previous version of an application. Migrate refuses to apply it unless
+	// Config.AllowBreaking is true, and Config.PendingBreaking returns the
+	// pending breaking migrations. It's set by LoadMigrations for files
+	// containing a "-- pgmigrate:breaking" comment at the top.
+	Breaking bool `json:"breaking,omitempty"`
+	// Func is executed instead of SQL if not nil, which allows to implement
+	// migrations that can't be expressed in SQL, e.g. re-encrypting a column.
+	// It's called with the transaction of the migration, or the db if the
+	// migration is NoTransaction, and its SQL has to be empty. It takes a
+	// Querier rather than a *sql.Tx so it works with any DB, but SQLTx
+	// returns the *sql.Tx of the transaction when using SQLDB. Changes to
+	// Func can't be detected, and LoadMigrations never returns Func
+	// migrations, so they need to be added to the loaded migrations.
+	Func func(ctx context.Context, q Querier) error `json:"-"`
 }
 
-// Valid returns an error if the migration is invalid.
+// Valid returns an error if the migration is invalid, including if its
+// description is a file name such as "5_foo.sql" with an id other than ID.
 func (m *Migration) Valid() error {
 	if m.ID < 1 {
 		return fmt.Errorf("invalid id: %d", m.ID)
 	} else if m.Description == "" {
 		return fmt.Errorf("missing description")
+	} else if match := nameRegexp.FindStringSubmatch(m.Description); match != nil {
+		if id, err := strconv.ParseInt(match[1], 10, 64); err == nil && id != m.ID {
+			return fmt.Errorf("id %d does not match file name %s", m.ID, m.Description)
+		}
+	}
+	if m.Func != nil {
+		if m.SQL != "" {
+			return errors.New("has both sql and func")
+		}
+		return nil
 	} else if m.SQL == "" {
 		return fmt.Errorf("missing sql")
+	} else if !hasEffectiveSQL(m.SQL) {
+		return errors.New("contains no executable SQL")
 	}
 	return nil
 }
 
+// Checksum returns the hex encoded sha256 hash of the SQL of m, followed by
+// a NUL byte and the DownSQL if it's not empty. For migrations without DownSQL
+// it's identical to the hash stored in the migrations table.
+func (m *Migration) Checksum() string {
+	if m.DownSQL == "" {
+		return sha256Hex(m.SQL)
+	}
+	return sha256Hex(m.SQL + "\x00" + m.DownSQL)
+}
+
 // Migrations holds a list of migrations sorted by id. The first migration
-// needs to have ID 1, and each following ID has to be incremented by 1.
+// needs to have ID 1, and each following ID has to be incremented by 1, unless
+// Config.AllowGaps is used.
 type Migrations []Migration
 
-// Less is part of the sort.Interface.
+// Less is part of the sort.Interface. Migrations with the same id are ordered
+// by description, so errors about duplicate ids are reproducible.
 func (m Migrations) Less(i, j int) bool {
-	return m[i].ID < m[j].ID
+	if m[i].ID != m[j].ID {
+		return m[i].ID < m[j].ID
+	}
+	return m[i].Description < m[j].Description
 }
 
 // Swap is part of the sort.Interface.
@@ -98,16 +535,173 @@ func (m Migrations) Len() int {
 
 // Valid returns an error if m holds an invalid migration list.
 func (m Migrations) Valid() error {
+	return m.valid(false)
+}
+
+// MustValid is like Valid, but panics on error. It allows to catch invalid
+// migrations without a db, e.g. in a test:
+//
+//	func TestMigrationsValid(t *testing.T) {
+//		pgmigrate.MustLoadMigrationsFS(migrationsFS).MustValid()
+//	}
+func (m Migrations) MustValid() {
+	if err := m.Valid(); err != nil {
+		panic(fmt.Sprintf("pgmigrate: %s", err))
+	}
+}
+
+// valid is like Valid, but if allowGaps is true, it only requires the ids of
+// m to be strictly increasing instead of starting at 1 and being incremented
+// by 1.
+func (m Migrations) valid(allowGaps bool) error {
 	for i := 0; i < len(m); i++ {
-		if m[i].ID != i+1 {
+		if i > 0 && m[i].ID == m[i-1].ID {
+			return fmt.Errorf("duplicate migration id %d: %s and %s", m[i].ID, m[i-1].Description, m[i].Description)
+		} else if !allowGaps && m[i].ID != int64(i+1) {
 			return fmt.Errorf("unexpected migration id: got=%d want=%d", m[i].ID, i+1)
+		} else if allowGaps && i > 0 && m[i].ID <= m[i-1].ID {
+			return fmt.Errorf("unexpected migration id: got=%d want>%d", m[i].ID, m[i-1].ID)
 		} else if err := m[i].Valid(); err != nil {
-			return fmt.Errorf("invalid migration %d: %s", m[i].ID, err)
+			return fmt.Errorf("invalid migration %d: %w", m[i].ID, err)
+		}
+	}
+	return nil
+}
+
+// validate validates ms according to the configured AllowGaps and
+// DescriptionPattern.
+func (c *Config) validate(ms Migrations) error {
+	if err := ms.valid(c.AllowGaps); err != nil {
+		return err
+	}
+	for _, m := range ms {
+		if c.DescriptionPattern != nil && !c.DescriptionPattern.MatchString(m.Description) {
+			return fmt.Errorf("invalid migration %d: description %q does not match %s", m.ID, m.Description, c.DescriptionPattern)
+		}
+	}
+	return c.validateOrder(ms)
+}
+
+// validateOrder returns an error if Order is not nil and not a permutation of
+// the ids of ms.
+func (c *Config) validateOrder(ms Migrations) error {
+	if c.Order == nil {
+		return nil
+	}
+	seen := make(map[int64]bool, len(c.Order))
+	for _, id := range c.Order {
+		i := sort.Search(len(ms), func(i int) bool { return ms[i].ID >= id })
+		if i == len(ms) || ms[i].ID != id {
+			return fmt.Errorf("invalid order: unknown migration id %d", id)
+		} else if seen[id] {
+			return fmt.Errorf("invalid order: duplicate migration id %d", id)
+		}
+		seen[id] = true
+	}
+	for _, m := range ms {
+		if !seen[m.ID] {
+			return fmt.Errorf("invalid order: missing migration id %d", m.ID)
 		}
 	}
 	return nil
 }
 
+// verify is like verifyStored, but uses the configured StrictDescription and
+// Order.
+func (c *Config) verify(stored []storedMigration, ms Migrations) (Migrations, error) {
+	if c.Order != nil {
+		pos := make(map[int64]int, len(c.Order))
+		for i, id := range c.Order {
+			pos[id] = i
+		}
+		// Unknown stored migrations are moved to the end, so they are reported
+		// as unknown.
+		position := func(id int64) int {
+			if p, ok := pos[id]; ok {
+				return p
+			}
+			return len(c.Order)
+		}
+		ms = append(Migrations{}, ms...)
+		sort.SliceStable(ms, func(i, j int) bool { return position(ms[i].ID) < position(ms[j].ID) })
+		stored = append([]storedMigration{}, stored...)
+		sort.SliceStable(stored, func(i, j int) bool { return position(stored[i].ID) < position(stored[j].ID) })
+	}
+	return verifyStored(stored, ms, c.StrictDescription)
+}
+
+// IDs returns the ids of m.
+func (m Migrations) IDs() []int64 {
+	ids := make([]int64, len(m))
+	for i, mi := range m {
+		ids[i] = mi.ID
+	}
+	return ids
+}
+
+// SetChecksum returns a hex encoded sha256 hash of the ordered ids,
+// descriptions and SQL of m. It fingerprints the whole migration set, so a
+// health check can compare it against the checksum stored by
+// Config.SetVersion instead of comparing migrations one by one.
+func (m Migrations) SetChecksum() string {
+	h := sha256.New()
+	for _, mi := range m {
+		writeSetEntry(h, mi.ID, mi.Description, sha256Hex(mi.SQL))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeSetEntry writes the SetChecksum entry of a single migration to w. The
+// SQL is included via its hash, which allows to compute the checksum from
+// the migrations table even if it doesn't retain the SQL.
+func writeSetEntry(w io.Writer, id int64, description, sqlHash string) {
+	fmt.Fprintf(w, "%d\x00%s\x00%s\n", id, description, sqlHash)
+}
+
+// maxID returns the highest id of m, or 0 if m is empty.
+func (m Migrations) maxID() int64 {
+	if len(m) == 0 {
+		return 0
+	}
+	return m[len(m)-1].ID
+}
+
+// without returns m without the migrations that have the same id as one of
+// other.
+func (m Migrations) without(other Migrations) Migrations {
+	ids := make(map[int64]bool, len(other))
+	for _, mi := range other {
+		ids[mi.ID] = true
+	}
+	result := make(Migrations, 0, len(m))
+	for _, mi := range m {
+		if !ids[mi.ID] {
+			result = append(result, mi)
+		}
+	}
+	return result
+}
+
+// hasTag returns true if m has the given tag.
+func (m Migration) hasTag(tag string) bool {
+	for _, t := range m.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// noTransaction returns true if any of m is NoTransaction.
+func (m Migrations) noTransaction() bool {
+	for _, mi := range m {
+		if mi.NoTransaction {
+			return true
+		}
+	}
+	return false
+}
+
 // DefaultConfig should be used by most users.
 var DefaultConfig = Config{
 	Schema: "migrations",
@@ -121,99 +715,2982 @@ type Config struct {
 	Schema string
 	// Table is the name of the migrations table.
 	Table string
+	// SkipCreateSchema disables creating the schema if it doesn't exist yet,
+	// e.g. for roles without the privilege to create schemas, in which case
+	// the schema has to exist already. Defaults to false.
+	SkipCreateSchema bool
+	// TableOwner is the role that is made the owner of the migrations table
+	// when it's initialized. Defaults to "", which keeps the role that
+	// created it.
+	TableOwner string
+	// GrantSelectTo holds roles that are granted SELECT on the migrations
+	// table when it's initialized, e.g. for monitoring. Defaults to nil.
+	GrantSelectTo []string
+	// CompressSQL causes the SQL of applied migrations to be retained for
+	// auditing, gzip compressed in a sql_gzip bytea column that is added to
+	// the migrations table. It's returned by Applied, and used for reporting
+	// which line of a modified migration changed. Defaults to false, which
+	// only stores the hash of the SQL.
+	CompressSQL bool
+	// IDColumn is the name of the id column of the migrations table.
+	// Defaults to "id".
+	IDColumn string
+	// DescriptionColumn is the name of the description column of the
+	// migrations table. Defaults to "description".
+	DescriptionColumn string
+	// SQLColumn is the name of the sql column of the migrations table.
+	// Defaults to "sql".
+	SQLColumn string
+	// DurationColumn is the name of the duration column of the migrations
+	// table. Defaults to "duration".
+	DurationColumn string
+	// DurationColumnType is the type of the duration column of the migrations
+	// table. It's only used when creating the table, so changing it for an
+	// existing table requires altering the column. Defaults to
+	// DurationInterval.
+	DurationColumnType DurationColumnType
+	// CreatedColumn is the name of the created column of the migrations
+	// table. Defaults to "created".
+	CreatedColumn string
+	// AllowGaps relaxes the validation of migrations to only require
+	// strictly increasing ids, e.g. to allow timestamp based ids. By default
+	// the first migration needs to have id 1, and each following id has to be
+	// incremented by 1.
+	AllowGaps bool
+	// DescriptionPattern is matched against the Description of every
+	// migration, which is usually its file name, e.g. to enforce a naming
+	// policy. Defaults to nil, which allows any description.
+	DescriptionPattern *regexp.Regexp
+	// TxMode controls how migrations are wrapped in transactions. Defaults to
+	// TxAll.
+	TxMode TxMode
+	// IsolationLevel is the isolation level of the transactions migrations
+	// are executed in. Higher levels such as sql.LevelSerializable can cause
+	// serialization failures, which are returned as migration errors.
+	// Defaults to sql.LevelDefault, which uses the default of the server.
+	IsolationLevel sql.IsolationLevel
+	// AdvisoryLockTimeout is the maximum time to wait for the advisory lock
+	// that prevents concurrent migrations. Defaults to waiting forever.
+	AdvisoryLockTimeout time.Duration
+	// AdvisoryLockKey is the key of the advisory lock that prevents
+	// concurrent migrations. Defaults to 0, which uses the 64-bit FNV-1a hash
+	// of the quoted and schema qualified table name, e.g.
+	// "migrations"."migrations", as the key. Setting it allows to avoid
+	// collisions with the advisory locks of other applications sharing the
+	// database.
+	AdvisoryLockKey int64
+	// StatementLockTimeout is the maximum time each migration may wait for
+	// acquiring a lock, e.g. on a table that is used by application queries,
+	// enforced by setting lock_timeout for the transaction, rounded up to
+	// whole milliseconds. This causes migrations to fail quickly instead of
+	// blocking. It does not apply to NoTransaction migrations. Defaults to no
+	// timeout.
+	StatementLockTimeout time.Duration
+	// StatementTimeout is the maximum time each migration may take to
+	// execute, enforced by setting statement_timeout for the transaction,
+	// rounded up to whole milliseconds. It does not apply to NoTransaction
+	// migrations. Defaults to no timeout.
+	StatementTimeout time.Duration
+	// SearchPath is the search_path for executing migrations, which allows
+	// migrations to use unqualified names. It's set for the transaction only
+	// and does not apply to NoTransaction migrations. Defaults to the
+	// search_path of the connection.
+	SearchPath []string
+	// SplitStatements causes the SQL of each migration to be split into
+	// individual statements that are executed one by one. This is useful for
+	// drivers that don't support executing multiple statements at once.
+	// Semicolons inside of string literals, quoted identifiers, dollar-quoted
+	// strings and comments are not treated as statement separators.
+	SplitStatements bool
+	// UseSavepoints causes each migration to be wrapped in a savepoint when
+	// all migrations are applied in a single transaction. A failed migration
+	// is rolled back to its savepoint, so the transaction is not left in an
+	// aborted state, but Migrate still rolls back all migrations.
+	UseSavepoints bool
+	// Vars holds the values for ${NAME} placeholders in the SQL and DownSQL
+	// of migrations, which are expanded before executing them. A placeholder
+	// without a value causes the migration to fail. A literal ${ can be
+	// written as $${. Other uses of $, e.g. for dollar quoting, are not
+	// affected. The migrations table stores the unexpanded SQL, so changing
+	// a value doesn't cause a modified migration error. Defaults to nil, which
+	// disables expansion.
+	Vars map[string]string
+	// RenderTemplates causes the SQL and DownSQL of each migration to be
+	// rendered as a text/template before executing it. The template can
+	// refer to the unquoted {{.Schema}} and {{.Table}} of the migrations
+	// table and to {{.Vars.NAME}}, and fails for missing Vars. It's rendered
+	// before Vars placeholders are expanded. Like with Vars, the migrations
+	// table stores the unrendered SQL. Defaults to false.
+	RenderTemplates bool
+	// RewriteSQL returns the SQL that is executed for a migration, e.g. to
+	// prepend "SET LOCAL role = 'ddl_admin';". It's called after Vars have
+	// been expanded, and not for Func migrations. For Rollback, it's called
+	// with a copy of the migration whose SQL is its DownSQL. The migrations
+	// table stores the original SQL, so changes to the rewritten SQL are not
+	// detected. Defaults to nil, which executes the SQL as is.
+	RewriteSQL func(m Migration) (string, error)
+	// AppliedBy is recorded in the migrations table for each applied
+	// migration, e.g. to identify the deploy that applied it. Defaults to the
+	// current postgres user.
+	AppliedBy string
+	// Revision is recorded in the migrations table for each applied
+	// migration, e.g. the git commit of the deploy that applied it. Defaults
+	// to "", which is stored as NULL.
+	Revision string
+	// MetaDB holds the migrations table if not nil, while the SQL of the
+	// migrations is executed against the db passed to Migrate, e.g. to keep
+	// track of the migrations of many tenant databases in a central database.
+	// The migration records are committed right after the migrations, but
+	// atomicity across two databases is best-effort: If committing the
+	// records fails, the migrations remain applied without being recorded.
+	// Rollback and Reapply don't support MetaDB. Defaults to nil.
+	MetaDB *sql.DB
+	// NotifyChannel is the channel that pg_notify is called with after
+	// Migrate successfully applied and committed at least one migration. The
+	// payload is a JSON object with the ids of the applied migrations, e.g.
+	// {"ids":[3,4]}. Defaults to "", which disables notifications.
+	NotifyChannel string
+	// AllowReset has to be true for Reset to be allowed, so test databases
+	// can't be reset by accident in production. Defaults to false.
+	AllowReset bool
+	// AllowBreaking has to be true for Migrate to apply migrations that are
+	// marked as Breaking, which allows deploy pipelines to require approval
+	// for them. Defaults to false.
+	AllowBreaking bool
+	// Order overrides the order in which migrations are applied, e.g. for
+	// applying a backfill before a schema change with a lower id without
+	// renumbering them. It has to be a permutation of the ids of the
+	// migrations. Defaults to nil, which applies migrations in the order of
+	// their ids.
+	Order []int64
+	// MatchBy controls how Migrate matches applied migrations to the given
+	// migrations. MatchByHash is meant as a one-time reconciliation aid for
+	// renumbered migrations. Defaults to MatchByID.
+	MatchBy MatchBy
+	// StrictDescription causes migrations whose description changed after
+	// they were applied, e.g. because their file was renamed, to be treated
+	// as modified and return a DescriptionChangedError. Defaults to false,
+	// which only logs a warning.
+	StrictDescription bool
+	// MaxApply limits the number of pending migrations applied by each call
+	// of Migrate and its variants to the first MaxApply in order, e.g. for
+	// applying at most one migration per deploy. The remaining migrations
+	// stay pending. Defaults to 0, which applies all pending migrations.
+	MaxApply int
+	// ContinueOnSchemaError causes MigrateAllSchemas to continue with the
+	// remaining schemas if migrating a schema fails. Defaults to false, which
+	// stops at the first failure.
+	ContinueOnSchemaError bool
+	// BeforeMigration is called before the SQL of each migration is
+	// executed, if not nil.
+	BeforeMigration func(m Migration)
+	// AfterMigration is called after the SQL of each migration has been
+	// executed, if not nil. A non-nil err means that the migration failed and
+	// its transaction will be rolled back.
+	AfterMigration func(m Migration, d time.Duration, err error)
+	// Progress is called before each pending migration is applied, if not
+	// nil. done is the number of migrations applied so far, and total the
+	// number of pending migrations, e.g. for logging "applying 3/12".
+	Progress func(done, total int, current Migration)
+	// Metrics receives metrics about applied migrations. Defaults to nil,
+	// which discards them.
+	Metrics Metrics
+	// Logger receives log messages about the progress of migrations, e.g. a
+	// *log.Logger. Defaults to nil, which discards them.
+	Logger Logger
+	// Tracer is called for tracing initializing the migrations table,
+	// verifying the applied migrations and applying each migration, e.g. by
+	// bridging it to OpenTelemetry. Defaults to nil, which disables tracing.
+	Tracer Tracer
+	// Store keeps track of the applied migrations instead of the migrations
+	// table, e.g. in a metadata service. Migrations are still executed
+	// against the db, which also holds the advisory lock. They are recorded
+	// after their transaction has been committed, so an error returned by
+	// Store.Record doesn't roll them back. Repair, Rollback, Reapply, Reset,
+	// ExplainPlan and MatchByHash are not supported with a Store. Defaults to
+	// nil, which uses the migrations table.
+	Store Store
+	// ConnectRetries is the number of times acquiring the migration lock and
+	// beginning the transaction for Migrate, Rollback and Repair is retried
+	// if it fails because of a connection error, e.g. during a failover.
+	// Errors caused by migrations are never retried. Defaults to 0.
+	ConnectRetries int
+	// RetryBackoff is the time to wait before the first retry, which is
+	// doubled for every following retry.
+	RetryBackoff time.Duration
+	// Now returns the current time, which is used for measuring the duration
+	// of migrations and recording when they were created. Defaults to nil,
+	// which uses time.Now.
+	Now func() time.Time
+}
+
+// Logger receives log messages, see Config.Logger.
+type Logger interface {
+	// Printf logs a message formatted like fmt.Printf.
+	Printf(format string, args ...interface{})
+}
+
+// nopLogger implements Logger by doing nothing.
+type nopLogger struct{}
+
+// Printf is part of the Logger interface.
+func (nopLogger) Printf(format string, args ...interface{}) {}
+
+// Metrics receives metrics about applied migrations. It allows to implement
+// e.g. a prometheus.Collector without pgmigrate depending on prometheus.
+type Metrics interface {
+	// MigrationApplied is called after the migration with the given id has
+	// been applied, which took d.
+	MigrationApplied(id int64, d time.Duration)
+	// MigrationFailed is called after applying the migration with the given
+	// id failed with err.
+	MigrationFailed(id int64, err error)
+}
+
+// nopMetrics implements Metrics by doing nothing.
+type nopMetrics struct{}
+
+// MigrationApplied is part of the Metrics interface.
+func (nopMetrics) MigrationApplied(id int64, d time.Duration) {}
+
+// MigrationFailed is part of the Metrics interface.
+func (nopMetrics) MigrationFailed(id int64, err error) {}
+
+// Tracer traces the work done by pgmigrate, e.g. by bridging it to
+// OpenTelemetry without pgmigrate depending on it, see Config.Tracer.
+type Tracer interface {
+	// StartSpan starts a span with the given name. The returned func is
+	// called with the outcome once the work of the span is done.
+	StartSpan(name string) (finish func(err error))
+}
+
+// nopTracer implements Tracer by doing nothing.
+type nopTracer struct{}
+
+// StartSpan is part of the Tracer interface.
+func (nopTracer) StartSpan(name string) func(err error) {
+	return func(error) {}
+}
+
+// Store keeps track of applied migrations, see Config.Store.
+type Store interface {
+	// Applied returns all applied migrations ordered by id, or an error. Each
+	// migration needs its SQL or SHA256 as it was recorded, so modified
+	// migrations can be detected.
+	Applied(ctx context.Context) ([]AppliedMigration, error)
+	// Record records am as applied, or returns an error.
+	Record(ctx context.Context, am AppliedMigration) error
 }
 
+// DurationColumnType is the type of the duration column of the migrations
+// table.
+type DurationColumnType int
+
+const (
+	// DurationInterval stores durations as an interval.
+	DurationInterval DurationColumnType = iota
+	// DurationMilliseconds stores durations as a bigint of milliseconds.
+	DurationMilliseconds
+)
+
+// TxMode controls how Migrate wraps migrations in transactions.
+type TxMode int
+
+const (
+	// TxAll applies all pending migrations in a single transaction, so either
+	// all of them or none of them are applied.
+	TxAll TxMode = iota
+	// TxPerMigration applies each pending migration in its own transaction.
+	// This means that migrations can end up partially applied: If a migration
+	// fails, all migrations before it remain committed and recorded.
+	TxPerMigration
+)
+
+// MatchBy controls how applied migrations are matched to the given
+// migrations.
+type MatchBy int
+
+const (
+	// MatchByID matches applied migrations by their id.
+	MatchByID MatchBy = iota
+	// MatchByHash matches applied migrations by the hash of their SQL and
+	// updates the id and description of applied migrations that have been
+	// renumbered, e.g. after a rebase. Migrations with an unknown hash are
+	// still matched by id.
+	MatchByHash
+)
+
 // Migrate validates ms, and on success applies any ms that has not already
 // been executed. The return value is either an error, or a list of all
-// migrations that were applied.
+// migrations that were applied. An empty list means that the db was already
+// up to date and has not been changed. IsUpToDate checks this without
+// applying any migrations.
 func (c *Config) Migrate(db *sql.DB, ms Migrations) (Migrations, error) {
-	if err := ms.Valid(); err != nil {
+	return c.MigrateContext(context.Background(), db, ms)
+}
+
+// MigrateContext is like Migrate, but stops when ctx is cancelled, including
+// while waiting for the advisory lock, in which case all migrations applied
+// in the current transaction are rolled back. If the deadline of ctx is
+// exceeded, the returned error wraps context.DeadlineExceeded.
+func (c *Config) MigrateContext(ctx context.Context, db *sql.DB, ms Migrations) (Migrations, error) {
+	return resultMigrations(c.migrate(ctx, SQLDB(db), ms, nil))
+}
+
+// MigrateDB is like Migrate, but accepts any DB implementation.
+func (c *Config) MigrateDB(db DB, ms Migrations) (Migrations, error) {
+	return resultMigrations(c.migrate(context.Background(), db, ms, nil))
+}
+
+// Result holds a migration applied by MigrateResult.
+type Result struct {
+	Migration
+	// Duration is the time it took to execute the migration.
+	Duration time.Duration
+}
+
+// MigrateResult is like Migrate, but returns the applied migrations in the
+// order they were applied along with the time it took to execute them.
+func (c *Config) MigrateResult(db *sql.DB, ms Migrations) ([]Result, error) {
+	return c.migrate(context.Background(), SQLDB(db), ms, nil)
+}
+
+// MigrateReport describes the outcome of Config.MigrateReport, e.g. for
+// reporting "8 already applied, 2 newly applied" after a deploy.
+type MigrateReport struct {
+	// Applied holds the migrations that were applied, in the order they were
+	// applied.
+	Applied Migrations `json:"applied"`
+	// AlreadyApplied holds the ids of the migrations that had been applied
+	// before.
+	AlreadyApplied []int64 `json:"already_applied"`
+	// Pending holds the ids of the migrations that are still pending, e.g.
+	// because of MaxApply.
+	Pending []int64 `json:"pending"`
+	// Durations holds the time it took to execute each of Applied by id.
+	Durations map[int64]time.Duration `json:"durations"`
+	// Duration is the time it took to migrate, including acquiring the lock
+	// and verifying the applied migrations.
+	Duration time.Duration `json:"duration"`
+}
+
+// MigrateReport is like Migrate, but returns a report that also includes the
+// migrations that had already been applied and the time it took to apply
+// them.
+func (c *Config) MigrateReport(db *sql.DB, ms Migrations) (*MigrateReport, error) {
+	var (
+		start   = c.now()
+		report  = &MigrateReport{}
+		pending Migrations
+	)
+	results, err := c.migrate(context.Background(), SQLDB(db), ms, func(applied, p Migrations) (Migrations, error) {
+		report.AlreadyApplied, pending = applied.IDs(), p
+		return p, nil
+	})
+	if err != nil {
 		return nil, err
 	}
-	tx, err := db.Begin()
+	report.Applied, _ = resultMigrations(results, nil)
+	report.Pending = pending.without(report.Applied).IDs()
+	report.Durations = make(map[int64]time.Duration, len(results))
+	for _, r := range results {
+		report.Durations[r.ID] = r.Duration
+	}
+	report.Duration = c.now().Sub(start)
+	return report, nil
+}
+
+// resultMigrations returns the migrations of results, or err.
+func resultMigrations(results []Result, err error) (Migrations, error) {
 	if err != nil {
 		return nil, err
 	}
-	defer tx.Rollback()
-	if err := c.init(tx); err != nil {
+	ms := make(Migrations, len(results))
+	for i, r := range results {
+		ms[i] = r.Migration
+	}
+	return ms, nil
+}
+
+// MigrateTo is like Migrate, but only applies migrations with an id less than
+// or equal to targetID. It returns an error if targetID is greater than the
+// highest id in ms, or less than the highest id that has already been
+// applied.
+func (c *Config) MigrateTo(db *sql.DB, ms Migrations, targetID int64) (Migrations, error) {
+	return resultMigrations(c.migrate(context.Background(), SQLDB(db), ms, func(applied, pending Migrations) (Migrations, error) {
+		if maxID := ms.maxID(); targetID > maxID {
+			return nil, fmt.Errorf("target id %d is greater than the highest migration id %d", targetID, maxID)
+		} else if appliedID := applied.maxID(); targetID < appliedID {
+			return nil, fmt.Errorf("target id %d is less than the highest applied migration id %d", targetID, appliedID)
+		}
+		for i, m := range pending {
+			if m.ID > targetID {
+				return pending[:i], nil
+			}
+		}
+		return pending, nil
+	}))
+}
+
+// MigrateTagged is like Migrate, but only applies the pending migrations that
+// have the given tag, in the order of their ids. It stops at the first pending
+// migration without tags, so migrations without tags are never skipped. The
+// skipped migrations are applied by a later Migrate, or MigrateTagged with one
+// of their tags.
+func (c *Config) MigrateTagged(db *sql.DB, ms Migrations, tag string) (Migrations, error) {
+	return resultMigrations(c.migrate(context.Background(), SQLDB(db), ms, func(applied, pending Migrations) (Migrations, error) {
+		var tagged Migrations
+		for _, m := range pending {
+			if len(m.Tags) == 0 {
+				break
+			} else if m.hasTag(tag) {
+				tagged = append(tagged, m)
+			}
+		}
+		return tagged, nil
+	}))
+}
+
+// MigrateTx is like Migrate, but applies ms in tx without committing it, so
+// they can be combined with other changes in a single transaction that is
+// controlled by the caller. If it returns an error, tx has to be rolled back.
+// The advisory lock is acquired with pg_advisory_xact_lock and held until tx
+// ends, and AdvisoryLockTimeout, ConnectRetries and TxMode don't apply.
+// Settings such as StatementLockTimeout remain in effect for the rest of tx.
+// NoTransaction migrations, MetaDB and Store are not supported.
+func (c *Config) MigrateTx(tx *sql.Tx, ms Migrations) (Migrations, error) {
+	if err := c.validate(ms); err != nil {
 		return nil, err
-	} else if ms, err = c.verifyMigrations(tx, ms); err != nil {
+	} else if c.MetaDB != nil {
+		return nil, errors.New("migrate tx is not supported with MetaDB")
+	} else if c.Store != nil {
+		return nil, errors.New("migrate tx is not supported with Store")
+	}
+	ctx := context.Background()
+	t := sqlTx{tx}
+	if err := t.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", c.lockKey()); err != nil {
+		return nil, fmt.Errorf("could not acquire migration lock: %w", err)
+	} else if err := c.init(ctx, t); err != nil {
+		return nil, err
+	}
+	pending, err := c.verifyMigrations(ctx, t, ms)
+	if err != nil {
+		return nil, err
+	}
+	if pending, err = c.applicablePending(pending); err != nil {
+		return nil, err
+	}
+	for _, m := range pending {
+		if m.NoTransaction {
+			return nil, fmt.Errorf("%d %s: NoTransaction migrations are not supported by MigrateTx", m.ID, m.Description)
+		}
+	}
+	if err := checkMinVersion(ctx, t, pending); err != nil {
+		return nil, err
+	}
+	results, _, err := c.applyMigrationsInTx(ctx, t, t, pending)
+	if err != nil {
+		return nil, err
+	} else if err := c.notify(ctx, t, results); err != nil {
 		return nil, err
-	} else {
-		return c.applyMigrations(tx, ms)
 	}
+	return resultMigrations(results, nil)
 }
 
-// init initializes the migrations schema and table if it does not exist yet.
-func (c *Config) init(tx *sql.Tx) error {
-	sql := `
-CREATE SCHEMA IF NOT EXISTS ` + quoteIdentifier(c.Schema) + `;
-CREATE TABLE IF NOT EXISTS ` + c.table() + ` (
-  id int NOT NULL,
-	description text NOT NULL,
-	sql text NOT NULL,
-	duration interval NOT NULL,
-  created timestamp without time zone DEFAULT (now() AT TIME ZONE 'UTC') NOT NULL
-);
-`
-	_, err := tx.Exec(sql)
-	return err
+// SchemaResult holds the outcome of migrating one schema with
+// MigrateAllSchemas.
+type SchemaResult struct {
+	// Schema is the name of the schema.
+	Schema string
+	// Migrations holds the migrations that were applied to the schema.
+	Migrations Migrations
+	// Err is the error that occurred while migrating the schema, if any.
+	Err error
 }
 
-// table returns the schema qualified and quoted table name.
-func (c *Config) table() string {
-	return quoteIdentifier(c.Schema) + "." + quoteIdentifier(c.Table)
+// MigrateAllSchemas is like Migrate, but applies ms to each of schemas in
+// order, e.g. for a db with one schema per tenant. Each schema holds its own
+// migrations table and is the search_path for executing ms, so unqualified
+// names refer to objects of the schema. The Schema and SearchPath of c are
+// ignored.
+//
+// It returns the results of all schemas that were migrated, and the first
+// error, if any. Unless ContinueOnSchemaError is set, the first error stops
+// migrating the remaining schemas.
+func (c *Config) MigrateAllSchemas(db *sql.DB, ms Migrations, schemas []string) ([]SchemaResult, error) {
+	var (
+		results  = make([]SchemaResult, 0, len(schemas))
+		firstErr error
+	)
+	for _, schema := range schemas {
+		sc := *c
+		sc.Schema = schema
+		sc.SearchPath = []string{schema}
+		applied, err := sc.Migrate(db, ms)
+		results = append(results, SchemaResult{Schema: schema, Migrations: applied, Err: err})
+		if err == nil {
+			continue
+		} else if firstErr == nil {
+			firstErr = fmt.Errorf("schema %s: %w", schema, err)
+		}
+		if !c.ContinueOnSchemaError {
+			break
+		}
+	}
+	return results, firstErr
 }
 
-// verifyMigrations verifies that the db contains an umodified subset of ms
-// and returns the migrations that have not yet been applied or an error.
-func (c *Config) verifyMigrations(tx *sql.Tx, ms Migrations) (Migrations, error) {
-	sql := "SELECT id, description, sql FROM " + c.table() + " ORDER BY id ASC"
-	rows, err := tx.Query(sql)
+// migrate implements Migrate. If selectPending is not nil, it's called with
+// the applied and pending migrations and returns the migrations that should be
+// applied, or an error. If the deadline of ctx is exceeded, the returned error
+// wraps context.DeadlineExceeded.
+func (c *Config) migrate(ctx context.Context, db DB, ms Migrations, selectPending func(applied, pending Migrations) (Migrations, error)) ([]Result, error) {
+	results, err := c.migrateTx(ctx, db, ms, selectPending)
+	if err != nil && ctx.Err() == context.DeadlineExceeded && !errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("migration deadline exceeded: %s: %w", err, ctx.Err())
+	}
+	return results, err
+}
+
+// migrateTx implements migrate.
+func (c *Config) migrateTx(ctx context.Context, db DB, ms Migrations, selectPending func(applied, pending Migrations) (Migrations, error)) ([]Result, error) {
+	if err := c.validate(ms); err != nil {
+		return nil, err
+	}
+	meta := c.metaDB(db)
+	tx, release, err := c.begin(ctx, meta)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var dbM Migration
-		if err := rows.Scan(&dbM.ID, &dbM.Description, &dbM.SQL); err != nil {
+	defer release()
+	pending, err := c.verifyMigrations(ctx, tx, ms)
+	if err != nil {
+		return nil, err
+	} else if selectPending != nil {
+		if pending, err = selectPending(ms.without(pending), pending); err != nil {
 			return nil, err
 		}
-		if len(ms) == 0 {
-			return nil, fmt.Errorf("unknown migration %d in db", dbM.ID)
-		} else if dbM != ms[0] {
-			return nil, fmt.Errorf("modified migration %d detected", dbM.ID)
-		}
-		ms = ms[1:]
 	}
-	if err := rows.Err(); err != nil {
+	if pending, err = c.applicablePending(pending); err != nil {
 		return nil, err
 	}
-	return ms, nil
+	var q Querier = tx
+	if c.MetaDB != nil {
+		q = db
+	}
+	if err := checkMinVersion(ctx, q, pending); err != nil {
+		return nil, err
+	}
+	var results []Result
+	if c.TxMode != TxPerMigration && !pending.noTransaction() {
+		results, err = c.applyMigrations(ctx, db, tx, pending)
+	} else if err = tx.Commit(); err == nil {
+		results, err = c.applyMigrationsPerTx(ctx, db, meta, pending)
+	}
+	if err != nil {
+		return nil, err
+	} else if err := c.notify(ctx, db, results); err != nil {
+		return nil, fmt.Errorf("migrations applied, but notify failed: %w", err)
+	}
+	return results, nil
 }
 
-// applyMigrations applies ms to the db and returns them or an erorr.
-func (c *Config) applyMigrations(tx *sql.Tx, ms Migrations) (Migrations, error) {
-	sql := "INSERT INTO " + c.table() + " (id, description, sql, duration) VALUES ($1, $2, $3, $4)"
-	for _, m := range ms {
-		start := time.Now()
-		if _, err := tx.Exec(m.SQL); err != nil {
-			return nil, fmt.Errorf("%d %s: %s", m.ID, m.Description, err)
-		}
-		duration := time.Since(start).Seconds()
-		if _, err := tx.Exec(sql, m.ID, m.Description, m.SQL, duration); err != nil {
-			return nil, fmt.Errorf("%d %s: %s", m.ID, m.Description, err)
-		}
+// applicablePending returns the pending migrations that Migrate applies,
+// which are the first MaxApply of them if MaxApply is set, or an error if any
+// of them is Breaking and AllowBreaking is not set. ExplainPlan uses it as
+// well, so its script matches what Migrate would execute.
+func (c *Config) applicablePending(pending Migrations) (Migrations, error) {
+	if c.MaxApply > 0 && len(pending) > c.MaxApply {
+		c.logger().Printf("applying %d of %d pending migrations, see MaxApply", c.MaxApply, len(pending))
+		pending = pending[:c.MaxApply]
 	}
-	if err := tx.Commit(); err != nil {
+	if err := c.checkBreaking(pending); err != nil {
 		return nil, err
-	} else {
-		return ms, nil
 	}
+	return pending, nil
 }
 
-// quoteIdentifier quotes name to be used as an identifier in a postgres SQL
-// query. The implementation is copied from lib/pq.
+// notify calls pg_notify for the NotifyChannel with the ids of the applied
+// migrations, unless NotifyChannel is empty or no migrations were applied.
+func (c *Config) notify(ctx context.Context, q Querier, results []Result) error {
+	if c.NotifyChannel == "" || len(results) == 0 {
+		return nil
+	}
+	payload := struct {
+		IDs []int64 `json:"ids"`
+	}{IDs: make([]int64, len(results))}
+	for i, r := range results {
+		payload.IDs[i] = r.ID
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return q.Exec(ctx, "SELECT pg_notify($1, $2)", c.NotifyChannel, string(data))
+}
+
+// checkBreaking returns an error if any of ms is Breaking, unless
+// AllowBreaking is true.
+func (c *Config) checkBreaking(ms Migrations) error {
+	if c.AllowBreaking {
+		return nil
+	}
+	for _, m := range ms {
+		if m.Breaking {
+			return fmt.Errorf("%d %s: breaking migration is not allowed, see Config.AllowBreaking", m.ID, m.Description)
+		}
+	}
+	return nil
+}
+
+// checkMinVersion returns an error if any of ms requires a newer major
+// version than the postgres server of q. The server version is only queried
+// if any of ms has a MinVersion.
+func checkMinVersion(ctx context.Context, q Querier, ms Migrations) error {
+	var version int
+	for _, m := range ms {
+		if m.MinVersion == 0 {
+			continue
+		} else if version == 0 {
+			num, err := serverVersionNum(ctx, q)
+			if err != nil {
+				return err
+			}
+			version = num / 10000
+		}
+		if version < m.MinVersion {
+			return fmt.Errorf("%d %s: requires postgres %d, but the server is postgres %d", m.ID, m.Description, m.MinVersion, version)
+		}
+	}
+	return nil
+}
+
+// serverVersionNum returns the server_version_num of the postgres server of
+// q, e.g. 150004 for 15.4, or an error.
+func serverVersionNum(ctx context.Context, q Querier) (int, error) {
+	rows, err := q.Query(ctx, "SHOW server_version_num")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var num string
+	if rows.Next() {
+		err = rows.Scan(&num)
+	} else if err = rows.Err(); err == nil {
+		err = errors.New("server_version_num returned no rows")
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(num)
+}
+
+// metaDB returns the DB holding the migrations table, which is the MetaDB if
+// configured, or db otherwise.
+func (c *Config) metaDB(db DB) DB {
+	if c.MetaDB != nil {
+		return SQLDB(c.MetaDB)
+	}
+	return db
+}
+
+// ApplyOne applies m regardless of which other migrations have been
+// applied, unless a migration with the same id has already been applied.
+//
+// This is an escape hatch for applying hotfixes during incidents and is
+// unsafe: Applying migrations out of order causes the migrations table to
+// deviate from the sequence of migrations that Migrate expects, so Migrate
+// returns an OutOfOrderError until the skipped migrations with lower ids have
+// been applied with ApplyOne as well.
+func (c *Config) ApplyOne(db *sql.DB, m Migration) error {
+	if err := m.Valid(); err != nil {
+		return fmt.Errorf("invalid migration %d: %w", m.ID, err)
+	}
+	ctx := context.Background()
+	meta := c.metaDB(SQLDB(db))
+	tx, release, err := c.begin(ctx, meta)
+	if err != nil {
+		return err
+	}
+	defer release()
+	stored, err := c.storedMigrations(ctx, tx)
+	if err != nil {
+		return err
+	}
+	for _, sm := range stored {
+		if sm.ID == m.ID {
+			return fmt.Errorf("migration %d has already been applied", m.ID)
+		}
+	}
+	if err := c.checkBreaking(Migrations{m}); err != nil {
+		return err
+	}
+	var q Querier = tx
+	if c.MetaDB != nil {
+		q = SQLDB(db)
+	}
+	if err := checkMinVersion(ctx, q, Migrations{m}); err != nil {
+		return err
+	}
+	if !m.NoTransaction && c.MetaDB == nil {
+		start := c.now()
+		d, err := c.applyMigration(ctx, tx, tx, m)
+		if err != nil {
+			return err
+		} else if err := tx.Commit(); err != nil {
+			return err
+		}
+		return c.store(ctx, c.appliedMigration(m, d, start))
+	} else if err := tx.Commit(); err != nil {
+		return err
+	}
+	_, err = c.applyMigrationTx(ctx, SQLDB(db), meta, m)
+	return err
+}
+
+// Reapply executes the SQL of m again and updates the duration and creation
+// time recorded for it, e.g. to recreate a view that was dropped by accident.
+// It returns an error if m has not been applied or has been modified.
+//
+// This is an advanced tool for operators: The SQL of m has to be safe to
+// execute repeatedly, and other migrations that depend on it are not applied
+// again.
+func (c *Config) Reapply(db *sql.DB, m Migration) error {
+	if err := m.Valid(); err != nil {
+		return fmt.Errorf("invalid migration %d: %w", m.ID, err)
+	} else if c.MetaDB != nil {
+		return errors.New("reapply is not supported with MetaDB")
+	} else if c.Store != nil {
+		return errors.New("reapply is not supported with Store")
+	}
+	ctx := context.Background()
+	tx, release, err := c.begin(ctx, SQLDB(db))
+	if err != nil {
+		return err
+	}
+	defer release()
+	stored, err := c.storedMigrations(ctx, tx)
+	if err != nil {
+		return err
+	}
+	i := sort.Search(len(stored), func(i int) bool { return stored[i].ID >= m.ID })
+	if i == len(stored) || stored[i].ID != m.ID {
+		return fmt.Errorf("migration %d has not been applied", m.ID)
+	} else if err := stored[i].verify(m, len(stored), c.StrictDescription); err != nil {
+		return err
+	}
+	var q Querier = tx
+	if m.NoTransaction {
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		q = SQLDB(db)
+	}
+	start, duration, err := c.execMigration(ctx, q, m)
+	if err != nil {
+		return err
+	}
+	col := c.columns()
+	sql := "UPDATE " + c.table() + " SET " + col.duration + " = $1, " + col.created + " = $2 WHERE " + col.id + " = $3"
+	if err := q.Exec(ctx, sql, c.durationValue(duration), start.UTC(), m.ID); err != nil {
+		return fmt.Errorf("%d %s: %w", m.ID, m.Description, err)
+	} else if m.NoTransaction {
+		return nil
+	}
+	return tx.Commit()
+}
+
+// Pending validates ms, and on success returns all ms that have not been
+// executed yet, without executing them. Like Migrate, it returns an error if
+// the db contains modified or unknown migrations. The transaction used for
+// this is always rolled back, so the db is never modified.
+func (c *Config) Pending(db *sql.DB, ms Migrations) (Migrations, error) {
+	if err := c.validate(ms); err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	tx, err := c.metaDB(SQLDB(db)).Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := c.init(ctx, tx); err != nil {
+		return nil, err
+	}
+	return c.verifyMigrations(ctx, tx, ms)
+}
+
+// PendingBreaking is like Pending, but only returns the pending migrations
+// that are Breaking, so deploy pipelines can require approval before setting
+// AllowBreaking and applying them.
+func (c *Config) PendingBreaking(db *sql.DB, ms Migrations) (Migrations, error) {
+	pending, err := c.Pending(db, ms)
+	if err != nil {
+		return nil, err
+	}
+	breaking := Migrations{}
+	for _, m := range pending {
+		if m.Breaking {
+			breaking = append(breaking, m)
+		}
+	}
+	return breaking, nil
+}
+
+// Check validates ms, and on success executes all pending migrations in a
+// transaction that is always rolled back, e.g. for catching errors in CI
+// before deploying. It returns the error of the first migration that fails,
+// which includes its id. Like Migrate, it acquires the advisory lock and
+// returns an error if the db contains modified or unknown migrations.
+// NoTransaction migrations can't be rolled back, so Check returns an error
+// if any of the pending migrations is NoTransaction.
+func (c *Config) Check(db *sql.DB, ms Migrations) error {
+	if err := c.validate(ms); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	tx, release, err := c.begin(ctx, c.metaDB(SQLDB(db)))
+	if err != nil {
+		return err
+	}
+	defer release()
+	pending, err := c.verifyMigrations(ctx, tx, ms)
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		if m.NoTransaction {
+			return fmt.Errorf("%d %s: cannot check NoTransaction migration", m.ID, m.Description)
+		}
+	}
+	if c.MetaDB != nil {
+		if tx, err = c.beginTx(ctx, SQLDB(db)); err != nil {
+			return err
+		}
+		defer tx.Rollback()
+	}
+	if err := checkMinVersion(ctx, tx, pending); err != nil {
+		return err
+	}
+	for _, m := range pending {
+		if _, _, err := c.execMigration(ctx, tx, m); err != nil {
+			return err
+		}
+		c.logger().Printf("checked migration %d %s", m.ID, m.Description)
+	}
+	return nil
+}
+
+// IsUpToDate validates ms, and on success returns true if all ms have been
+// applied. Like Migrate, it returns an error if the db contains modified or
+// unknown migrations. Unlike Pending, it doesn't execute any DDL, so it can be
+// used with read-only connections, e.g. for health checks against replicas.
+func (c *Config) IsUpToDate(db *sql.DB, ms Migrations) (bool, error) {
+	if err := c.validate(ms); err != nil {
+		return false, err
+	}
+	stored, err := c.storedMigrationsIfExists(context.Background(), c.metaDB(SQLDB(db)))
+	if err != nil {
+		return false, err
+	}
+	pending, err := c.verify(stored, ms)
+	if err != nil {
+		return false, err
+	}
+	return len(pending) == 0, nil
+}
+
+// AppliedMigration holds a migration as recorded in the migrations table.
+type AppliedMigration struct {
+	Migration
+	// Duration is the time it took to execute the migration. It's marshaled
+	// as JSON in nanoseconds.
+	Duration time.Duration `json:"duration"`
+	// Created is the time the migration was applied at, in UTC.
+	Created time.Time `json:"created"`
+	// AppliedBy identifies who applied the migration, see Config.AppliedBy.
+	// It's empty for migrations applied by older versions of pgmigrate.
+	AppliedBy string `json:"applied_by"`
+	// Revision is the revision the migration was applied at, see
+	// Config.Revision. It's empty if no revision was configured.
+	Revision string `json:"revision,omitempty"`
+	// SHA256 is the hex encoded hash of the SQL of the migration. It's empty
+	// for migrations applied by older versions of pgmigrate, and a Store may
+	// leave it empty if it records the SQL instead.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// Applied returns all migrations recorded in the migrations table ordered by
+// id, or an error. Only the hash of the sql of each migration is stored, so
+// the SQL of the returned migrations is empty, unless they were applied by an
+// older version of pgmigrate or with CompressSQL. If the migrations table
+// doesn't exist yet, an empty list is returned. If a Store is configured, its
+// migrations are returned instead.
+func (c *Config) Applied(db *sql.DB) ([]AppliedMigration, error) {
+	ctx := context.Background()
+	if c.Store != nil {
+		return c.Store.Applied(ctx)
+	} else if exists, err := c.tableExists(ctx, c.metaDB(SQLDB(db))); err != nil {
+		return nil, err
+	} else if !exists {
+		return []AppliedMigration{}, nil
+	}
+	col, err := c.readColumns(ctx, c.metaDB(SQLDB(db)))
+	if err != nil {
+		return nil, err
+	}
+	sql := "SELECT " + col.id + ", " + col.description + ", " + col.sql + ", " + c.durationSeconds() + ", " + col.created +
+		", COALESCE(" + col.appliedBy + ", ''), COALESCE(" + col.revision + ", ''), " + col.sha256 + ", " + col.sqlGzip +
+		" FROM " + c.table() + " ORDER BY " + col.id + " ASC"
+	rows, err := c.metaDB(SQLDB(db)).Query(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ams := []AppliedMigration{}
+	for rows.Next() {
+		var (
+			am         AppliedMigration
+			duration   float64
+			compressed []byte
+		)
+		if err := rows.Scan(&am.ID, &am.Description, &am.SQL, &duration, &am.Created, &am.AppliedBy, &am.Revision, &am.SHA256, &compressed); err != nil {
+			return nil, err
+		} else if compressed != nil {
+			if am.SQL, err = decompressSQL(compressed); err != nil {
+				return nil, fmt.Errorf("decompress sql of migration %d: %w", am.ID, err)
+			}
+		}
+		am.Duration = time.Duration(math.Round(duration*1e6)) * time.Microsecond
+		am.Created = am.Created.UTC()
+		ams = append(ams, am)
+	}
+	return ams, rows.Err()
+}
+
+// Version returns the highest id recorded in the migrations table, or 0 if
+// the table is empty or doesn't exist yet. Like Applied, the db is not
+// modified.
+func (c *Config) Version(db *sql.DB) (int64, error) {
+	ctx := context.Background()
+	if c.Store != nil {
+		stored, err := c.storedMigrations(ctx, nil)
+		if err != nil || len(stored) == 0 {
+			return 0, err
+		}
+		return stored[len(stored)-1].ID, nil
+	} else if exists, err := c.tableExists(ctx, c.metaDB(SQLDB(db))); err != nil || !exists {
+		return 0, err
+	}
+	rows, err := c.metaDB(SQLDB(db)).Query(ctx, "SELECT COALESCE(max("+c.columns().id+"), 0) FROM "+c.table())
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var version int64
+	if rows.Next() {
+		err = rows.Scan(&version)
+	} else if err = rows.Err(); err == nil {
+		err = errors.New("max returned no rows")
+	}
+	return version, err
+}
+
+// SetVersion computes the SetChecksum of the migrations recorded in the
+// migrations table and stores it in the set_checksum row of a metadata table
+// next to it, which is named like Table with a _meta suffix. After migrating,
+// the stored checksum equals ms.SetChecksum() if all ms have been applied, so
+// a health check can compare the deployed and the expected migration set
+// with StoredSetChecksum.
+func (c *Config) SetVersion(db *sql.DB) error {
+	if c.Store != nil {
+		return errors.New("set version is not supported with Store")
+	}
+	ctx := context.Background()
+	tx, release, err := c.begin(ctx, c.metaDB(SQLDB(db)))
+	if err != nil {
+		return err
+	}
+	defer release()
+	stored, err := c.storedMigrations(ctx, tx)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	for _, sm := range stored {
+		sqlHash := sm.SHA256
+		if sqlHash == "" {
+			sqlHash = sha256Hex(sm.SQL)
+		}
+		writeSetEntry(h, sm.ID, sm.Description, sqlHash)
+	}
+	checksum := hex.EncodeToString(h.Sum(nil))
+	meta := c.metaTable()
+	if err := tx.Exec(ctx, "CREATE TABLE IF NOT EXISTS "+meta+" (key text PRIMARY KEY, value text NOT NULL, updated timestamp NOT NULL)"); err != nil {
+		return fmt.Errorf("create metadata table: %w", err)
+	}
+	sql := "INSERT INTO " + meta + " (key, value, updated) VALUES ('set_checksum', $1, $2) " +
+		"ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, updated = EXCLUDED.updated"
+	if err := tx.Exec(ctx, sql, checksum, c.now().UTC()); err != nil {
+		return fmt.Errorf("store set checksum: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	c.logger().Printf("stored set checksum %s of %d migrations", checksum, len(stored))
+	return nil
+}
+
+// StoredSetChecksum returns the checksum stored by SetVersion, or an empty
+// string if SetVersion hasn't been called yet. The db is not modified.
+func (c *Config) StoredSetChecksum(db *sql.DB) (string, error) {
+	ctx := context.Background()
+	meta := c.metaDB(SQLDB(db))
+	rows, err := meta.Query(ctx, "SELECT to_regclass($1) IS NOT NULL", c.metaTable())
+	if err != nil {
+		return "", err
+	}
+	var exists bool
+	if rows.Next() {
+		err = rows.Scan(&exists)
+	} else if err = rows.Err(); err == nil {
+		err = errors.New("to_regclass returned no rows")
+	}
+	rows.Close()
+	if err != nil || !exists {
+		return "", err
+	}
+	rows, err = meta.Query(ctx, "SELECT value FROM "+c.metaTable()+" WHERE key = 'set_checksum'")
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	var checksum string
+	if rows.Next() {
+		err = rows.Scan(&checksum)
+	} else {
+		err = rows.Err()
+	}
+	return checksum, err
+}
+
+// metaTable returns the schema qualified and quoted name of the metadata
+// table used by SetVersion.
+func (c *Config) metaTable() string {
+	return quoteIdentifier(c.Schema) + "." + quoteIdentifier(c.Table+"_meta")
+}
+
+// MigrationState describes the state of a migration, see MigrationStatus.
+type MigrationState int
+
+const (
+	// Pending means that the migration has not been applied yet.
+	Pending MigrationState = iota
+	// Applied means that the migration has been applied and not been
+	// modified since.
+	Applied
+	// Modified means that the migration has been applied, but has been
+	// modified since.
+	Modified
+	// Missing means that the migration has been applied, but is no longer
+	// part of the given migrations.
+	Missing
+)
+
+// String returns the name of s.
+func (s MigrationState) String() string {
+	switch s {
+	case Pending:
+		return "pending"
+	case Applied:
+		return "applied"
+	case Modified:
+		return "modified"
+	case Missing:
+		return "missing"
+	default:
+		return fmt.Sprintf("MigrationState(%d)", int(s))
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler, so states are marshaled as
+// JSON using their String value.
+func (s MigrationState) MarshalText() ([]byte, error) {
+	if s < Pending || s > Missing {
+		return nil, fmt.Errorf("invalid migration state: %d", int(s))
+	}
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *MigrationState) UnmarshalText(text []byte) error {
+	for state := Pending; state <= Missing; state++ {
+		if string(text) == state.String() {
+			*s = state
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid migration state: %q", text)
+}
+
+// MigrationStatus holds the state of a single migration.
+type MigrationStatus struct {
+	ID          int64          `json:"id"`
+	Description string         `json:"description"`
+	State       MigrationState `json:"state"`
+}
+
+// Status validates ms, and on success returns the state of every migration
+// that is part of ms or recorded in the migrations table, ordered by id. The
+// db is not modified, and all migrations are reported as pending if the
+// migrations table doesn't exist yet.
+func (c *Config) Status(db *sql.DB, ms Migrations) ([]MigrationStatus, error) {
+	if err := c.validate(ms); err != nil {
+		return nil, err
+	}
+	stored, err := c.storedMigrationsIfExists(context.Background(), c.metaDB(SQLDB(db)))
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int64]storedMigration, len(stored))
+	for _, sm := range stored {
+		byID[sm.ID] = sm
+	}
+	statuses := make([]MigrationStatus, 0, len(ms)+len(stored))
+	for _, m := range ms {
+		status := MigrationStatus{ID: m.ID, Description: m.Description, State: Pending}
+		if sm, ok := byID[m.ID]; ok && sm.matches(m, c.StrictDescription) {
+			status.State = Applied
+		} else if ok {
+			status.State = Modified
+		}
+		delete(byID, m.ID)
+		statuses = append(statuses, status)
+	}
+	for _, sm := range stored {
+		if _, ok := byID[sm.ID]; ok {
+			statuses = append(statuses, MigrationStatus{ID: sm.ID, Description: sm.Description, State: Missing})
+		}
+	}
+	sort.SliceStable(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses, nil
+}
+
+// Diff lists the differences between the migrations table and a list of
+// migrations by id, see Config.Diff.
+type Diff struct {
+	// Modified holds the ids of applied migrations that have been modified.
+	Modified []int64 `json:"modified"`
+	// Unknown holds the ids of applied migrations that are missing from the
+	// list of migrations.
+	Unknown []int64 `json:"unknown"`
+	// Pending holds the ids of migrations that have not been applied yet.
+	Pending []int64 `json:"pending"`
+}
+
+// Diff validates ms, and on success returns all differences between ms and
+// the migrations table. Unlike Migrate and Pending, which stop at the first
+// modified or unknown migration, it reports all of them. Like Status, the db
+// is not modified.
+func (c *Config) Diff(db *sql.DB, ms Migrations) (*Diff, error) {
+	statuses, err := c.Status(db, ms)
+	if err != nil {
+		return nil, err
+	}
+	d := &Diff{}
+	for _, s := range statuses {
+		switch s.State {
+		case Modified:
+			d.Modified = append(d.Modified, s.ID)
+		case Missing:
+			d.Unknown = append(d.Unknown, s.ID)
+		case Pending:
+			d.Pending = append(d.Pending, s.ID)
+		}
+	}
+	return d, nil
+}
+
+// Orphaned validates ms, and on success returns all migrations recorded in the
+// migrations table that are not part of ms, ordered by id. Only the hash of
+// the sql of each migration is stored, so the SQL of the returned migrations
+// is empty, unless they were applied by an older version of pgmigrate or with
+// CompressSQL. Like Status, the db is not modified.
+func (c *Config) Orphaned(db *sql.DB, ms Migrations) (Migrations, error) {
+	if err := c.validate(ms); err != nil {
+		return nil, err
+	}
+	stored, err := c.storedMigrationsIfExists(context.Background(), c.metaDB(SQLDB(db)))
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[int64]bool, len(ms))
+	for _, m := range ms {
+		ids[m.ID] = true
+	}
+	orphaned := Migrations{}
+	for _, sm := range stored {
+		if !ids[sm.ID] {
+			orphaned = append(orphaned, sm.Migration)
+		}
+	}
+	return orphaned, nil
+}
+
+// Plan describes what Migrate would do.
+type Plan struct {
+	// Applied holds the migrations that have already been applied.
+	Applied Migrations
+	// Pending holds the migrations that would be applied.
+	Pending Migrations
+	// err holds the drift that was detected, if any.
+	err error
+}
+
+// Valid returns an error if the db contains modified or unknown migrations,
+// in which case Migrate would fail, and Applied and Pending are empty.
+func (p *Plan) Valid() error {
+	return p.err
+}
+
+// String returns a human readable summary of p.
+func (p *Plan) String() string {
+	if p.err != nil {
+		return fmt.Sprintf("invalid plan: %s\n", p.err)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d applied, %d pending migrations\n", len(p.Applied), len(p.Pending))
+	for _, m := range p.Applied {
+		fmt.Fprintf(&b, "applied %d %s\n", m.ID, m.Description)
+	}
+	for _, m := range p.Pending {
+		fmt.Fprintf(&b, "pending %d %s\n", m.ID, m.Description)
+	}
+	return b.String()
+}
+
+// Plan validates ms, and on success returns a plan describing what Migrate
+// would do, or an error. Drift is not returned as an error, but reported by
+// Plan.Valid. Like Pending, this never modifies the db.
+func (c *Config) Plan(db *sql.DB, ms Migrations) (*Plan, error) {
+	if err := c.validate(ms); err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	tx, err := c.metaDB(SQLDB(db)).Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := c.init(ctx, tx); err != nil {
+		return nil, err
+	}
+	stored, err := c.storedMigrations(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := c.verify(stored, ms)
+	if err != nil {
+		return &Plan{err: err}, nil
+	}
+	return &Plan{Applied: ms.without(pending), Pending: pending}, nil
+}
+
+// ExplainPlan validates ms, and on success returns an SQL script with the
+// statements that Migrate would execute for applying the pending migrations,
+// including the SET LOCAL statements and the INSERTs into the migrations
+// table, or an error. The script records a duration of 0 for each migration,
+// and Func migrations are only included as a comment. Like Migrate, it only
+// includes the first MaxApply pending migrations, and returns an error for
+// Breaking migrations unless AllowBreaking is set. Like IsUpToDate, it
+// doesn't modify the db.
+func (c *Config) ExplainPlan(db *sql.DB, ms Migrations) (string, error) {
+	if err := c.validate(ms); err != nil {
+		return "", err
+	} else if c.Store != nil {
+		return "", errors.New("explain plan is not supported with Store")
+	}
+	stored, err := c.storedMigrationsIfExists(context.Background(), c.metaDB(SQLDB(db)))
+	if err != nil {
+		return "", err
+	}
+	pending, err := c.verify(stored, ms)
+	if err != nil {
+		return "", err
+	} else if pending, err = c.applicablePending(pending); err != nil {
+		return "", err
+	}
+	return c.explain(pending)
+}
+
+// explain returns the script of ExplainPlan for applying pending.
+func (c *Config) explain(pending Migrations) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "-- %d pending migrations for %s\n", len(pending), c.table())
+	if len(pending) == 0 {
+		return b.String(), nil
+	}
+	txAll := c.TxMode != TxPerMigration && !pending.noTransaction()
+	fmt.Fprintf(&b, "SELECT pg_advisory_lock(%d);\nBEGIN;\n%s", c.lockKey(), c.InitSQL())
+	if !txAll {
+		b.WriteString("COMMIT;\n")
+	}
+	for _, m := range pending {
+		fmt.Fprintf(&b, "\n-- %d %s\n", m.ID, m.Description)
+		if !txAll && !m.NoTransaction {
+			b.WriteString("BEGIN;\n")
+		}
+		if txAll && c.UseSavepoints {
+			b.WriteString("SAVEPOINT pgmigrate;\n")
+		}
+		if !m.NoTransaction {
+			for _, stmt := range c.setLocalSQL() {
+				b.WriteString(stmt + ";\n")
+			}
+		}
+		if err := c.explainSQL(&b, m); err != nil {
+			return "", err
+		}
+		appliedBy, revision := "current_user", "NULL"
+		if c.AppliedBy != "" {
+			appliedBy = quoteLiteral(c.AppliedBy)
+		}
+		if c.Revision != "" {
+			revision = quoteLiteral(c.Revision)
+		}
+		id := strconv.FormatInt(m.ID, 10)
+		values := []string{id, quoteLiteral(m.Description), quoteLiteral(recordedSQL(m)), quoteLiteral(sha256Hex(m.SQL)), "'0'", "now() AT TIME ZONE 'UTC'", appliedBy, revision}
+		if c.CompressSQL {
+			compressed, err := compressSQL(m.SQL)
+			if err != nil {
+				return "", err
+			} else if compressed == nil {
+				values = append(values, "NULL")
+			} else {
+				values = append(values, "decode('"+hex.EncodeToString(compressed)+"', 'hex')")
+			}
+		}
+		b.WriteString(c.recordSQL(values...) + ";\n")
+		if txAll && c.UseSavepoints {
+			b.WriteString("RELEASE SAVEPOINT pgmigrate;\n")
+		} else if !txAll && !m.NoTransaction {
+			b.WriteString("COMMIT;\n")
+		}
+	}
+	b.WriteString("\n")
+	if txAll {
+		b.WriteString("COMMIT;\n")
+	}
+	if c.NotifyChannel != "" {
+		payload, err := json.Marshal(struct {
+			IDs []int64 `json:"ids"`
+		}{pending.IDs()})
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "SELECT pg_notify(%s, %s);\n", quoteLiteral(c.NotifyChannel), quoteLiteral(string(payload)))
+	}
+	fmt.Fprintf(&b, "SELECT pg_advisory_unlock(%d);\n", c.lockKey())
+	return b.String(), nil
+}
+
+// explainSQL writes the statements that are executed for m to b, or returns
+// an error.
+func (c *Config) explainSQL(b *strings.Builder, m Migration) error {
+	if m.Func != nil {
+		b.WriteString(recordedSQL(m) + "\n")
+		return nil
+	}
+	sql, err := c.prepareSQL(m)
+	if err != nil {
+		return fmt.Errorf("%d %s: %w", m.ID, m.Description, err)
+	}
+	stmts := []string{sql}
+	if c.SplitStatements {
+		stmts = splitStatements(sql)
+	}
+	for _, stmt := range stmts {
+		stmt = strings.TrimRight(stmt, " \t\r\n")
+		if lastLine := stmt[strings.LastIndexByte(stmt, '\n')+1:]; strings.HasSuffix(stmt, ";") {
+			b.WriteString(stmt + "\n")
+		} else if strings.Contains(lastLine, "--") {
+			// The terminator would be commented out on the same line.
+			b.WriteString(stmt + "\n;\n")
+		} else {
+			b.WriteString(stmt + ";\n")
+		}
+	}
+	return nil
+}
+
+// Rollback validates ms, and on success reverts all migrations with an id
+// greater than toID that have been executed, in descending order, by
+// executing their DownSQL. The return value is either an error, or a list of
+// all migrations that were rolled back. DownSQL is executed like SQL, so
+// settings such as StatementTimeout, SearchPath, SplitStatements and Vars
+// apply to it as well. Like Migrate, Rollback reverts each migration in its
+// own transaction if any of them is NoTransaction, in which case the
+// DownSQL of NoTransaction migrations is executed directly against the db.
+func (c *Config) Rollback(db *sql.DB, ms Migrations, toID int64) (Migrations, error) {
+	if err := c.validate(ms); err != nil {
+		return nil, err
+	} else if c.MetaDB != nil {
+		return nil, errors.New("rollback is not supported with MetaDB")
+	} else if c.Store != nil {
+		return nil, errors.New("rollback is not supported with Store")
+	}
+	ctx := context.Background()
+	tx, release, err := c.begin(ctx, SQLDB(db))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	pending, err := c.verifyMigrations(ctx, tx, ms)
+	if err != nil {
+		return nil, err
+	}
+	var rollback Migrations
+	applied := ms.without(pending)
+	for i := len(applied) - 1; i >= 0 && applied[i].ID > toID; i-- {
+		if applied[i].DownSQL == "" {
+			return nil, fmt.Errorf("missing down sql for migration %d", applied[i].ID)
+		}
+		rollback = append(rollback, applied[i])
+	}
+	return c.rollbackMigrations(ctx, SQLDB(db), tx, rollback)
+}
+
+// Repair validates ms, and on success updates the stored hash of every
+// applied migration to match its current SQL, without executing it. This
+// resolves "modified migration" errors for migrations that were changed after
+// being applied, e.g. to fix a typo. The id and description of every applied
+// migration still have to match, so unknown or renamed migrations are
+// returned as an error.
+func (c *Config) Repair(db *sql.DB, ms Migrations) error {
+	if err := c.validate(ms); err != nil {
+		return err
+	} else if c.Store != nil {
+		return errors.New("repair is not supported with Store")
+	}
+	ctx := context.Background()
+	tx, release, err := c.begin(ctx, c.metaDB(SQLDB(db)))
+	if err != nil {
+		return err
+	}
+	defer release()
+	stored, err := c.storedMigrations(ctx, tx)
+	if err != nil {
+		return err
+	}
+	existing, err := c.existingColumns(ctx, tx)
+	if err != nil {
+		return err
+	}
+	col := c.columns()
+	sql := "UPDATE " + c.table() + " SET " + col.sql + " = '', " + col.sha256 + " = $1"
+	if existing["sql_gzip"] {
+		// Keep the retained SQL in sync with the hash, or clear it if
+		// CompressSQL has been disabled, so it's not stale if it's enabled
+		// again.
+		sql += ", " + col.sqlGzip + " = $3"
+	}
+	sql += " WHERE " + col.id + " = $2"
+	for _, sm := range stored {
+		i := sort.Search(len(ms), func(i int) bool { return ms[i].ID >= sm.ID })
+		if i == len(ms) || sm.ID != ms[i].ID {
+			return &UnknownMigrationError{ID: sm.ID}
+		} else if sm.Description != ms[i].Description {
+			return fmt.Errorf("cannot repair migration %d: description mismatch: db=%q want=%q", sm.ID, sm.Description, ms[i].Description)
+		} else if sm.matches(ms[i], c.StrictDescription) {
+			continue
+		}
+		args := []interface{}{sha256Hex(ms[i].SQL), sm.ID}
+		if existing["sql_gzip"] {
+			var compressed []byte
+			if c.CompressSQL {
+				if compressed, err = compressSQL(ms[i].SQL); err != nil {
+					return fmt.Errorf("%d %s: %w", sm.ID, sm.Description, err)
+				}
+			}
+			args = append(args, compressed)
+		}
+		if err := tx.Exec(ctx, sql, args...); err != nil {
+			return fmt.Errorf("%d %s: %w", sm.ID, sm.Description, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Baseline validates ms, and on success records all ms with an id less than
+// or equal to upToID as applied, without executing them. This allows to adopt
+// pgmigrate for a db whose schema has been created by other means. It
+// returns an error if the migrations table is not empty, or if upToID is not
+// the id of one of ms.
+func (c *Config) Baseline(db *sql.DB, ms Migrations, upToID int64) error {
+	if err := c.validate(ms); err != nil {
+		return err
+	}
+	i := sort.Search(len(ms), func(i int) bool { return ms[i].ID >= upToID })
+	if i == len(ms) || ms[i].ID != upToID {
+		return fmt.Errorf("unknown baseline migration id %d", upToID)
+	}
+	ctx := context.Background()
+	tx, release, err := c.begin(ctx, c.metaDB(SQLDB(db)))
+	if err != nil {
+		return err
+	}
+	defer release()
+	if stored, err := c.storedMigrations(ctx, tx); err != nil {
+		return err
+	} else if len(stored) > 0 {
+		return fmt.Errorf("cannot baseline: migrations table contains %d migrations", len(stored))
+	}
+	now := c.now()
+	if c.Store != nil {
+		for _, m := range ms[:i+1] {
+			if err := c.Store.Record(ctx, c.appliedMigration(m, 0, now)); err != nil {
+				return fmt.Errorf("%d %s: %w", m.ID, m.Description, err)
+			}
+		}
+		return nil
+	}
+	for _, m := range ms[:i+1] {
+		if err := c.record(ctx, tx, m, 0, now); err != nil {
+			return fmt.Errorf("%d %s: %w", m.ID, m.Description, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Reset drops the schema of the migrations table including all objects in
+// it, or only the migrations table if SkipCreateSchema is set, so all
+// migrations will be applied again by the next Migrate. It's meant for
+// setting up test databases and returns an error unless AllowReset is true.
+func (c *Config) Reset(db *sql.DB) error {
+	if !c.AllowReset {
+		return errors.New("reset is not allowed, see Config.AllowReset")
+	} else if c.Store != nil {
+		return errors.New("reset is not supported with Store")
+	}
+	ctx := context.Background()
+	meta := c.metaDB(SQLDB(db))
+	unlock, err := c.lock(ctx, meta)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	sql := "DROP TABLE IF EXISTS " + c.table()
+	if !c.SkipCreateSchema {
+		sql = "DROP SCHEMA IF EXISTS " + quoteIdentifier(c.Schema) + " CASCADE"
+	}
+	if err := meta.Exec(ctx, sql); err != nil {
+		return err
+	}
+	c.logger().Printf("reset migrations table %s", c.table())
+	return nil
+}
+
+// begin acquires the migration lock, begins a transaction and initializes the
+// migrations table. It returns the transaction and a function for rolling it
+// back and releasing the lock, or an error. Connection errors are retried
+// according to ConnectRetries.
+func (c *Config) begin(ctx context.Context, db DB) (Tx, func(), error) {
+	var (
+		tx     Tx
+		unlock func()
+	)
+	err := c.retry(ctx, func() error {
+		var err error
+		if unlock, err = c.lock(ctx, db); err != nil {
+			return err
+		} else if tx, err = c.beginTx(ctx, db); err != nil {
+			unlock()
+			return err
+		} else if err = c.init(ctx, tx); err != nil {
+			tx.Rollback()
+			unlock()
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return tx, func() {
+		tx.Rollback()
+		unlock()
+	}, nil
+}
+
+// beginTx begins a transaction with the configured IsolationLevel, or returns
+// an error. The DB interface doesn't accept transaction options, so the level
+// is set by the first statement of the transaction.
+func (c *Config) beginTx(ctx context.Context, db DB) (Tx, error) {
+	var level string
+	switch c.IsolationLevel {
+	case sql.LevelDefault:
+		return db.Begin(ctx)
+	case sql.LevelReadUncommitted:
+		level = "READ UNCOMMITTED"
+	case sql.LevelReadCommitted:
+		level = "READ COMMITTED"
+	case sql.LevelRepeatableRead:
+		level = "REPEATABLE READ"
+	case sql.LevelSerializable:
+		level = "SERIALIZABLE"
+	default:
+		return nil, fmt.Errorf("unsupported isolation level: %s", c.IsolationLevel)
+	}
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	} else if err := tx.Exec(ctx, "SET TRANSACTION ISOLATION LEVEL "+level); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+// lock acquires a session level advisory lock on a dedicated connection to
+// prevent concurrent migrations of the same migrations table, and returns a
+// function for releasing it or an error. This means that migrations require
+// one more connection than usual.
+func (c *Config) lock(ctx context.Context, db DB) (func(), error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	lockCtx := ctx
+	if c.AdvisoryLockTimeout > 0 {
+		var cancel context.CancelFunc
+		lockCtx, cancel = context.WithTimeout(ctx, c.AdvisoryLockTimeout)
+		defer cancel()
+	}
+	key := c.lockKey()
+	if err := conn.Exec(lockCtx, "SELECT pg_advisory_lock($1)", key); err != nil {
+		conn.Close()
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("migration lock wait deadline exceeded: %w", ctx.Err())
+		} else if ctx.Err() != nil {
+			return nil, fmt.Errorf("migration lock wait cancelled: %w", ctx.Err())
+		} else if lockCtx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("could not acquire migration lock: timeout after %s", c.AdvisoryLockTimeout)
+		}
+		return nil, fmt.Errorf("could not acquire migration lock: %w", err)
+	}
+	return func() {
+		// The lock has to be released even if ctx has been cancelled, because
+		// closing conn returns it to the pool without ending its session.
+		conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", key)
+		conn.Close()
+	}, nil
+}
+
+// lockKey returns the configured AdvisoryLockKey, or the advisory lock key
+// derived from the migrations table.
+func (c *Config) lockKey() int64 {
+	if c.AdvisoryLockKey != 0 {
+		return c.AdvisoryLockKey
+	}
+	h := fnv.New64a()
+	h.Write([]byte(c.table()))
+	return int64(h.Sum64())
+}
+
+// init initializes the migrations schema and table if it does not exist yet,
+// and adds the columns that are missing from tables created by older versions
+// of pgmigrate. The columns are looked up first, because altering the table
+// requires an exclusive lock even if the columns already exist.
+func (c *Config) init(ctx context.Context, tx Tx) error {
+	if c.Store != nil {
+		return nil
+	}
+	finish := c.tracer().StartSpan("pgmigrate.init")
+	err := c.initTable(ctx, tx)
+	finish(err)
+	return err
+}
+
+// initTable implements init.
+func (c *Config) initTable(ctx context.Context, tx Tx) error {
+	if err := tx.Exec(ctx, c.createSQL()); err != nil {
+		return err
+	}
+	missing, err := c.missingColumns(ctx, tx)
+	if err != nil {
+		return err
+	}
+	for _, ac := range missing {
+		if err := tx.Exec(ctx, c.addColumnSQL(ac.name, ac.def)); err != nil {
+			return fmt.Errorf("add column %s: %w", ac.name, err)
+		}
+		c.logger().Printf("added column %s to migrations table %s", ac.name, c.table())
+	}
+	if err := tx.Exec(ctx, c.indexSQL()); err != nil {
+		return fmt.Errorf("create unique index on migration ids: %w", err)
+	}
+	if err := c.setPrivileges(ctx, tx); err != nil {
+		return fmt.Errorf("set privileges of migrations table: %w", err)
+	}
+	c.logger().Printf("initialized migrations table %s", c.table())
+	return nil
+}
+
+// addedColumn is a column that has been added to the migrations table by a
+// newer version of pgmigrate.
+type addedColumn struct {
+	name, def string
+}
+
+// addedColumns holds the columns that have been added to the migrations table
+// by newer versions of pgmigrate.
+var addedColumns = []addedColumn{
+	{"sha256", "text NOT NULL DEFAULT ''"},
+	{"applied_by", "text"},
+	{"revision", "text"},
+}
+
+// addedColumns returns the addedColumns, followed by the sql_gzip column if
+// CompressSQL is enabled.
+func (c *Config) addedColumns() []addedColumn {
+	if !c.CompressSQL {
+		return addedColumns
+	}
+	return append(addedColumns[:len(addedColumns):len(addedColumns)], addedColumn{"sql_gzip", "bytea"})
+}
+
+// missingColumns returns the addedColumns that the migrations table doesn't
+// have yet, or an error.
+func (c *Config) missingColumns(ctx context.Context, q Querier) ([]addedColumn, error) {
+	existing, err := c.existingColumns(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	var missing []addedColumn
+	for _, ac := range c.addedColumns() {
+		if !existing[ac.name] {
+			missing = append(missing, ac)
+		}
+	}
+	return missing, nil
+}
+
+// existingColumns returns the names of the columns of the migrations table,
+// or an error.
+func (c *Config) existingColumns(ctx context.Context, q Querier) (map[string]bool, error) {
+	sql := "SELECT column_name FROM information_schema.columns WHERE table_schema = $1 AND table_name = $2"
+	rows, err := q.Query(ctx, sql, c.Schema, c.Table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	existing := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		existing[name] = true
+	}
+	return existing, rows.Err()
+}
+
+// readColumns is like columns, but returns default values for the added
+// columns that the migrations table doesn't have yet, so read only callers
+// such as Applied or Status work before Migrate has upgraded the table. The
+// sql_gzip column is also replaced if CompressSQL is disabled.
+func (c *Config) readColumns(ctx context.Context, q Querier) (columns, error) {
+	existing, err := c.existingColumns(ctx, q)
+	if err != nil {
+		return columns{}, err
+	}
+	col := c.columns()
+	defaults := []struct {
+		name, value string
+		col         *string
+	}{
+		{"sha256", "''::text", &col.sha256},
+		{"applied_by", "NULL::text", &col.appliedBy},
+		{"revision", "NULL::text", &col.revision},
+		{"sql_gzip", "NULL::bytea", &col.sqlGzip},
+	}
+	for _, d := range defaults {
+		if !existing[d.name] || (d.name == "sql_gzip" && !c.CompressSQL) {
+			*d.col = d.value
+		}
+	}
+	return col, nil
+}
+
+// InitSQL returns the DDL for creating the migrations table, and its schema
+// unless SkipCreateSchema is set, if they don't exist yet, and for adding the
+// columns and the unique index that are missing from tables created by older
+// versions of pgmigrate. It allows a DBA to review and apply it manually,
+// before running Migrate with SkipCreateSchema set.
+func (c *Config) InitSQL() string {
+	sql := c.createSQL()
+	for _, ac := range c.addedColumns() {
+		sql += c.addColumnSQL(ac.name, ac.def)
+	}
+	return sql + c.indexSQL() + c.privilegesSQL()
+}
+
+// createSQL returns the DDL for creating the migrations table, and its schema
+// unless SkipCreateSchema is set, if they don't exist yet.
+func (c *Config) createSQL() string {
+	col := c.columns()
+	var sql string
+	if !c.SkipCreateSchema {
+		sql = "CREATE SCHEMA IF NOT EXISTS " + quoteIdentifier(c.Schema) + ";\n"
+	}
+	return sql + `CREATE TABLE IF NOT EXISTS ` + c.table() + ` (
+  ` + col.id + ` bigint NOT NULL,
+  ` + col.description + ` text NOT NULL,
+  ` + col.sql + ` text NOT NULL,
+  ` + col.sha256 + ` text NOT NULL DEFAULT '',
+  ` + col.duration + ` ` + c.durationType() + ` NOT NULL,
+  ` + col.created + ` timestamp without time zone DEFAULT (now() AT TIME ZONE 'UTC') NOT NULL,
+  ` + col.appliedBy + ` text,
+  ` + col.revision + ` text
+);
+`
+}
+
+// indexSQL returns the DDL for creating the unique index on the id column of
+// the migrations table if it doesn't exist yet. It causes concurrent attempts
+// to record the same migration to fail, even if they bypass the advisory lock.
+// Tables created by older versions of pgmigrate don't have it.
+func (c *Config) indexSQL() string {
+	col := c.columns()
+	name := quoteIdentifier(c.Table + "_id_key")
+	return "CREATE UNIQUE INDEX IF NOT EXISTS " + name + " ON " + c.table() + " (" + col.id + ");\n"
+}
+
+// setPrivileges sets the configured TableOwner and GrantSelectTo privileges
+// of the migrations table. Like for the columns, the current privileges are
+// looked up first, because altering the table requires an exclusive lock.
+func (c *Config) setPrivileges(ctx context.Context, tx Tx) error {
+	var sql string
+	if c.TableOwner != "" {
+		var owner string
+		if err := queryRow(ctx, tx, "SELECT tableowner FROM pg_tables WHERE schemaname = $1 AND tablename = $2", []interface{}{c.Schema, c.Table}, &owner); err != nil {
+			return err
+		} else if owner != c.TableOwner {
+			sql += c.ownerSQL()
+		}
+	}
+	var grantTo []string
+	for _, role := range c.GrantSelectTo {
+		var ok bool
+		if err := queryRow(ctx, tx, "SELECT has_table_privilege($1, $2, 'SELECT')", []interface{}{role, c.table()}, &ok); err != nil {
+			return err
+		} else if !ok {
+			grantTo = append(grantTo, role)
+		}
+	}
+	if sql += c.grantSQL(grantTo); sql == "" {
+		return nil
+	}
+	return tx.Exec(ctx, sql)
+}
+
+// privilegesSQL returns the DDL for setting the configured TableOwner and
+// GrantSelectTo privileges of the migrations table, or an empty string.
+func (c *Config) privilegesSQL() string {
+	return c.ownerSQL() + c.grantSQL(c.GrantSelectTo)
+}
+
+// ownerSQL returns the DDL for making TableOwner the owner of the migrations
+// table, or an empty string if TableOwner is not set.
+func (c *Config) ownerSQL() string {
+	if c.TableOwner == "" {
+		return ""
+	}
+	return "ALTER TABLE " + c.table() + " OWNER TO " + quoteIdentifier(c.TableOwner) + ";\n"
+}
+
+// grantSQL returns the DDL for granting SELECT on the migrations table to
+// roles, or an empty string if there are no roles.
+func (c *Config) grantSQL(roles []string) string {
+	if len(roles) == 0 {
+		return ""
+	}
+	quoted := make([]string, len(roles))
+	for i, role := range roles {
+		quoted[i] = quoteIdentifier(role)
+	}
+	return "GRANT SELECT ON " + c.table() + " TO " + strings.Join(quoted, ", ") + ";\n"
+}
+
+// queryRow executes sql with args using q and scans the first row into dest,
+// or returns an error if there is no row.
+func queryRow(ctx context.Context, q Querier, sql string, args []interface{}, dest ...interface{}) error {
+	rows, err := q.Query(ctx, sql, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		return rows.Scan(dest...)
+	} else if err := rows.Err(); err != nil {
+		return err
+	}
+	return errors.New("query returned no rows")
+}
+
+// addColumnSQL returns the DDL for adding the column name with the given
+// definition to the migrations table if it doesn't exist yet.
+func (c *Config) addColumnSQL(name, def string) string {
+	return "ALTER TABLE " + c.table() + " ADD COLUMN IF NOT EXISTS " + quoteIdentifier(name) + " " + def + ";\n"
+}
+
+// TableName returns the quoted and schema qualified name of the migrations
+// table, e.g. "migrations"."migrations" for the DefaultConfig, which allows to
+// query it directly.
+func (c *Config) TableName() string {
+	return c.table()
+}
+
+// table returns the schema qualified and quoted table name.
+func (c *Config) table() string {
+	return quoteIdentifier(c.Schema) + "." + quoteIdentifier(c.Table)
+}
+
+// columns holds the quoted column names of the migrations table.
+type columns struct {
+	id, description, sql, sha256, duration, created, appliedBy, revision, sqlGzip string
+}
+
+// columns returns the quoted column names of the migrations table.
+func (c *Config) columns() columns {
+	return columns{
+		id:          quoteColumn(c.IDColumn, "id"),
+		description: quoteColumn(c.DescriptionColumn, "description"),
+		sql:         quoteColumn(c.SQLColumn, "sql"),
+		sha256:      quoteIdentifier("sha256"),
+		duration:    quoteColumn(c.DurationColumn, "duration"),
+		created:     quoteColumn(c.CreatedColumn, "created"),
+		appliedBy:   quoteIdentifier("applied_by"),
+		revision:    quoteIdentifier("revision"),
+		sqlGzip:     quoteIdentifier("sql_gzip"),
+	}
+}
+
+// quoteColumn returns the quoted name, or the quoted def if name is empty.
+func quoteColumn(name, def string) string {
+	if name == "" {
+		name = def
+	}
+	return quoteIdentifier(name)
+}
+
+// tableExists returns true if the migrations table exists, or an error.
+func (c *Config) tableExists(ctx context.Context, q Querier) (bool, error) {
+	rows, err := q.Query(ctx, "SELECT to_regclass($1) IS NOT NULL", c.table())
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	var exists bool
+	if rows.Next() {
+		err = rows.Scan(&exists)
+	} else if err = rows.Err(); err == nil {
+		err = errors.New("to_regclass returned no rows")
+	}
+	return exists, err
+}
+
+// verifyMigrations verifies that the db contains an umodified subset of ms
+// and returns the migrations that have not yet been applied or an error.
+func (c *Config) verifyMigrations(ctx context.Context, tx Tx, ms Migrations) (Migrations, error) {
+	finish := c.tracer().StartSpan("pgmigrate.verify")
+	pending, err := c.verifyTable(ctx, tx, ms)
+	finish(err)
+	return pending, err
+}
+
+// verifyTable implements verifyMigrations.
+func (c *Config) verifyTable(ctx context.Context, tx Tx, ms Migrations) (Migrations, error) {
+	stored, err := c.storedMigrations(ctx, tx)
+	if err != nil {
+		return nil, err
+	} else if c.MatchBy == MatchByHash {
+		if c.Store != nil {
+			return nil, errors.New("MatchByHash is not supported with Store")
+		} else if stored, err = c.renumber(ctx, tx, stored, ms); err != nil {
+			return nil, err
+		}
+	}
+	pending, err := c.verify(stored, ms)
+	if err != nil {
+		c.logger().Printf("drift detected: %s", err)
+		return nil, err
+	}
+	for _, sm := range stored {
+		i := sort.Search(len(ms), func(i int) bool { return ms[i].ID >= sm.ID })
+		if sm.Description != ms[i].Description {
+			c.logger().Printf("description of migration %d changed from %q to %q", sm.ID, sm.Description, ms[i].Description)
+		}
+	}
+	return pending, nil
+}
+
+// renumber updates the id and description of every stored migration whose
+// sql hash matches one of ms with a different id, and returns the updated
+// stored migrations ordered by id, or an error. Migrations with the same hash
+// are matched in order.
+func (c *Config) renumber(ctx context.Context, tx Tx, stored []storedMigration, ms Migrations) ([]storedMigration, error) {
+	byHash := make(map[string]Migrations, len(ms))
+	for _, m := range ms {
+		hash := sha256Hex(m.SQL)
+		byHash[hash] = append(byHash[hash], m)
+	}
+	col := c.columns()
+	// Rows are moved to negative ids first, so swapped ids don't collide.
+	sql := "UPDATE " + c.table() + " SET " + col.id + " = $1, " + col.description + " = $2 WHERE " + col.id + " = $3"
+	var renumbered bool
+	for i, sm := range stored {
+		hash := sm.SHA256
+		if hash == "" {
+			hash = sha256Hex(sm.SQL)
+		}
+		matches := byHash[hash]
+		if len(matches) == 0 {
+			continue
+		}
+		m := matches[0]
+		byHash[hash] = matches[1:]
+		if m.ID == sm.ID {
+			continue
+		} else if err := tx.Exec(ctx, sql, -m.ID, m.Description, sm.ID); err != nil {
+			return nil, fmt.Errorf("renumber migration %d: %w", sm.ID, err)
+		}
+		c.logger().Printf("renumbered migration %d %s to %d %s", sm.ID, sm.Description, m.ID, m.Description)
+		stored[i].ID, stored[i].Description = m.ID, m.Description
+		renumbered = true
+	}
+	if !renumbered {
+		return stored, nil
+	} else if err := tx.Exec(ctx, "UPDATE "+c.table()+" SET "+col.id+" = -"+col.id+" WHERE "+col.id+" < 0"); err != nil {
+		return nil, err
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].ID < stored[j].ID })
+	return stored, nil
+}
+
+// verifyStored verifies that stored is an unmodified subset of ms and returns
+// the migrations that have not yet been applied or an error. Differing
+// descriptions are only treated as modifications if strict is true. Pending
+// migrations with tags may precede applied migrations, because MigrateTagged
+// skips them.
+func verifyStored(stored []storedMigration, ms Migrations, strict bool) (Migrations, error) {
+	var skipped Migrations
+	for _, sm := range stored {
+		for len(ms) > 0 && ms[0].ID < sm.ID && len(ms[0].Tags) > 0 {
+			skipped = append(skipped, ms[0])
+			ms = ms[1:]
+		}
+		if len(ms) == 0 {
+			return nil, &UnknownMigrationError{ID: sm.ID}
+		} else if ms[0].ID < sm.ID {
+			i := sort.Search(len(ms), func(i int) bool { return ms[i].ID >= sm.ID })
+			if i < len(ms) && ms[i].ID == sm.ID {
+				return nil, &OutOfOrderError{ID: sm.ID, Skipped: ms[:i].IDs()}
+			}
+		}
+		if err := sm.verify(ms[0], len(stored), strict); err != nil {
+			return nil, err
+		}
+		ms = ms[1:]
+	}
+	if len(skipped) > 0 {
+		return append(skipped, ms...), nil
+	}
+	return ms, nil
+}
+
+var (
+	// ErrModifiedMigration is matched by errors.Is for a
+	// ModifiedMigrationError.
+	ErrModifiedMigration = errors.New("modified migration")
+	// ErrUnknownMigration is matched by errors.Is for an
+	// UnknownMigrationError.
+	ErrUnknownMigration = errors.New("unknown migration")
+	// ErrDescriptionChanged is matched by errors.Is for a
+	// DescriptionChangedError.
+	ErrDescriptionChanged = errors.New("description changed")
+	// ErrOutOfOrder is matched by errors.Is for an OutOfOrderError.
+	ErrOutOfOrder = errors.New("migration applied out of order")
+)
+
+// ModifiedMigrationError is returned if a migration has been modified after
+// it was applied.
+type ModifiedMigrationError struct {
+	// ID is the id of the modified migration.
+	ID int64
+	// Applied is the number of migrations in the migrations table.
+	Applied int
+	// Diff describes the first difference between the applied and the
+	// modified migration, e.g. the first line that changed. It's empty if
+	// only the hash of the applied migration is known.
+	Diff string
+}
+
+// Error is part of the error interface.
+func (e *ModifiedMigrationError) Error() string {
+	msg := fmt.Sprintf("modified migration %d detected (%d applied)", e.ID, e.Applied)
+	if e.Diff != "" {
+		msg += ": " + e.Diff
+	}
+	return msg
+}
+
+// Is returns true if target is ErrModifiedMigration.
+func (e *ModifiedMigrationError) Is(target error) bool {
+	return target == ErrModifiedMigration
+}
+
+// DescriptionChangedError is returned if StrictDescription is set and the
+// description of a migration changed after it was applied, but its SQL did
+// not.
+type DescriptionChangedError struct {
+	// ID is the id of the migration.
+	ID int64
+	// Got is the description of the given migration.
+	Got string
+	// Want is the description the migration was applied with.
+	Want string
+}
+
+// Error is part of the error interface.
+func (e *DescriptionChangedError) Error() string {
+	return fmt.Sprintf("description changed for migration %d: got %q want %q", e.ID, e.Got, e.Want)
+}
+
+// Is returns true if target is ErrDescriptionChanged or ErrModifiedMigration,
+// because StrictDescription treats these migrations as modified.
+func (e *DescriptionChangedError) Is(target error) bool {
+	return target == ErrDescriptionChanged || target == ErrModifiedMigration
+}
+
+// OutOfOrderError is returned if a migration has been applied with ApplyOne
+// before migrations with lower ids, which have to be applied with ApplyOne as
+// well before Migrate can continue.
+type OutOfOrderError struct {
+	// ID is the id of the migration that was applied out of order.
+	ID int64
+	// Skipped holds the ids of the migrations with lower ids that have not
+	// been applied.
+	Skipped []int64
+}
+
+// Error is part of the error interface.
+func (e *OutOfOrderError) Error() string {
+	ids := make([]string, len(e.Skipped))
+	for i, id := range e.Skipped {
+		ids[i] = strconv.FormatInt(id, 10)
+	}
+	return fmt.Sprintf("migration %d was applied out of order, apply skipped migrations %s with ApplyOne", e.ID, strings.Join(ids, ", "))
+}
+
+// Is returns true if target is ErrOutOfOrder.
+func (e *OutOfOrderError) Is(target error) bool {
+	return target == ErrOutOfOrder
+}
+
+// UnknownMigrationError is returned if the db contains a migration that is
+// not part of the given migrations.
+type UnknownMigrationError struct {
+	// ID is the id of the unknown migration.
+	ID int64
+}
+
+// Error is part of the error interface.
+func (e *UnknownMigrationError) Error() string {
+	return fmt.Sprintf("unknown migration %d in db", e.ID)
+}
+
+// Is returns true if target is ErrUnknownMigration.
+func (e *UnknownMigrationError) Is(target error) bool {
+	return target == ErrUnknownMigration
+}
+
+// storedMigration holds a migration as stored in the migrations table.
+type storedMigration struct {
+	Migration
+	// SHA256 is the hex encoded hash of the SQL of the migration. It's empty
+	// for rows created by older versions of pgmigrate which stored the SQL
+	// instead.
+	SHA256 string
+}
+
+// matches returns true if m has the same id as sm, the same description if
+// strict is true, and has not been modified or is AllowModified. Migrations
+// are compared by their sha256 hash, except for rows created by older
+// versions of pgmigrate which are compared by their full sql.
+func (sm storedMigration) matches(m Migration, strict bool) bool {
+	if sm.ID != m.ID || (strict && sm.Description != m.Description) {
+		return false
+	} else if m.AllowModified {
+		return true
+	} else if sm.SHA256 != "" {
+		return sm.SHA256 == sha256Hex(m.SQL)
+	}
+	return sm.SQL == m.SQL
+}
+
+// verify returns a ModifiedMigrationError if sm doesn't match m, or a
+// DescriptionChangedError if only the description differs and strict is true.
+// applied is the number of migrations in the migrations table.
+func (sm storedMigration) verify(m Migration, applied int, strict bool) error {
+	if !sm.matches(m, false) {
+		return &ModifiedMigrationError{ID: sm.ID, Applied: applied, Diff: sm.diff(m)}
+	} else if strict && sm.Description != m.Description {
+		return &DescriptionChangedError{ID: sm.ID, Got: m.Description, Want: sm.Description}
+	}
+	return nil
+}
+
+// diff returns a short description of the first difference between the SQL
+// of sm and m, or an empty string if it's unknown because only the hash of sm
+// is known.
+func (sm storedMigration) diff(m Migration) string {
+	if sm.SHA256 != "" && sm.SQL == "" {
+		return ""
+	}
+	before, after := strings.Split(sm.SQL, "\n"), strings.Split(m.SQL, "\n")
+	for i := 0; i < len(before) || i < len(after); i++ {
+		var b, a string
+		if i < len(before) {
+			b = before[i]
+		}
+		if i < len(after) {
+			a = after[i]
+		}
+		if a != b {
+			return fmt.Sprintf("line %d changed from %q to %q", i+1, truncate(b, 40), truncate(a, 40))
+		}
+	}
+	return ""
+}
+
+// truncate returns s shortened to at most n bytes followed by "...". It
+// doesn't cut a multi-byte character in half.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for i := 0; i < utf8.UTFMax-1 && n > 0 && !utf8.RuneStart(s[n]); i++ {
+		n--
+	}
+	return s[:n] + "..."
+}
+
+// storedMigrations returns all migrations stored in the migrations table
+// ordered by id, or an error.
+func (c *Config) storedMigrations(ctx context.Context, q Querier) ([]storedMigration, error) {
+	if c.Store != nil {
+		ams, err := c.Store.Applied(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("store: %w", err)
+		}
+		stored := make([]storedMigration, len(ams))
+		for i, am := range ams {
+			stored[i] = storedMigration{Migration: am.Migration, SHA256: am.SHA256}
+		}
+		sort.SliceStable(stored, func(i, j int) bool { return stored[i].ID < stored[j].ID })
+		return stored, nil
+	}
+	col, err := c.readColumns(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	sql := "SELECT " + col.id + ", " + col.description + ", " + col.sql + ", " + col.sha256 + ", " + col.sqlGzip +
+		" FROM " + c.table() + " ORDER BY " + col.id + " ASC"
+	rows, err := q.Query(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var stored []storedMigration
+	for rows.Next() {
+		var (
+			sm         storedMigration
+			compressed []byte
+		)
+		if err := rows.Scan(&sm.ID, &sm.Description, &sm.SQL, &sm.SHA256, &compressed); err != nil {
+			return nil, err
+		} else if compressed != nil {
+			if sm.SQL, err = decompressSQL(compressed); err != nil {
+				return nil, fmt.Errorf("decompress sql of migration %d: %w", sm.ID, err)
+			}
+		}
+		stored = append(stored, sm)
+	}
+	return stored, rows.Err()
+}
+
+// storedMigrationsIfExists is like storedMigrations, but returns no
+// migrations if the migrations table doesn't exist, instead of creating it.
+func (c *Config) storedMigrationsIfExists(ctx context.Context, q Querier) ([]storedMigration, error) {
+	if c.Store != nil {
+		return c.storedMigrations(ctx, q)
+	} else if exists, err := c.tableExists(ctx, q); err != nil || !exists {
+		return nil, err
+	}
+	return c.storedMigrations(ctx, q)
+}
+
+// applyMigrations applies ms to the db in metaTx, or in a separate
+// transaction if MetaDB is configured, and returns the results or an erorr.
+func (c *Config) applyMigrations(ctx context.Context, db DB, metaTx Tx, ms Migrations) ([]Result, error) {
+	tx := metaTx
+	if c.MetaDB != nil {
+		var err error
+		if tx, err = c.beginTx(ctx, db); err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+	}
+	results, applied, err := c.applyMigrationsInTx(ctx, tx, metaTx, ms)
+	if err != nil {
+		return nil, err
+	} else if err := c.commit(tx, metaTx); err != nil {
+		return nil, err
+	} else if err := c.store(ctx, applied...); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// applyMigrationsInTx is like applyMigrations, but doesn't commit tx and
+// metaTx. It also returns the migrations that need to be recorded in the
+// Store after committing, if one is configured.
+func (c *Config) applyMigrationsInTx(ctx context.Context, tx Tx, metaTx Querier, ms Migrations) ([]Result, []AppliedMigration, error) {
+	var (
+		results = make([]Result, 0, len(ms))
+		applied []AppliedMigration
+	)
+	for i, m := range ms {
+		c.progress(i, len(ms), m)
+		start := c.now()
+		d, err := c.applyMigrationSavepoint(ctx, tx, metaTx, m)
+		if err != nil {
+			return nil, nil, err
+		}
+		results = append(results, Result{Migration: m, Duration: d})
+		if c.Store != nil {
+			applied = append(applied, c.appliedMigration(m, d, start))
+		}
+	}
+	return results, applied, nil
+}
+
+// appliedMigration returns m as recorded by record.
+func (c *Config) appliedMigration(m Migration, d time.Duration, start time.Time) AppliedMigration {
+	return AppliedMigration{
+		Migration: m,
+		Duration:  d,
+		Created:   start.UTC(),
+		AppliedBy: c.AppliedBy,
+		Revision:  c.Revision,
+		SHA256:    sha256Hex(m.SQL),
+	}
+}
+
+// store records ams in the Store, if configured. It's called after the
+// migrations have been committed.
+func (c *Config) store(ctx context.Context, ams ...AppliedMigration) error {
+	if c.Store == nil {
+		return nil
+	}
+	for _, am := range ams {
+		if err := c.Store.Record(ctx, am); err != nil {
+			return fmt.Errorf("migration %d applied, but not recorded in Store: %w", am.ID, err)
+		}
+	}
+	return nil
+}
+
+// progress calls Progress, if configured.
+func (c *Config) progress(done, total int, current Migration) {
+	if c.Progress != nil {
+		c.Progress(done, total, current)
+	}
+}
+
+// commit commits tx, followed by metaTx if MetaDB is configured.
+func (c *Config) commit(tx, metaTx Tx) error {
+	if err := tx.Commit(); err != nil || c.MetaDB == nil {
+		return err
+	} else if err := metaTx.Commit(); err != nil {
+		return fmt.Errorf("migrations applied, but not recorded in MetaDB: %w", err)
+	}
+	return nil
+}
+
+// applyMigrationSavepoint is like applyMigration, but wraps m in a savepoint
+// if UseSavepoints is enabled.
+func (c *Config) applyMigrationSavepoint(ctx context.Context, tx Tx, meta Querier, m Migration) (time.Duration, error) {
+	if !c.UseSavepoints {
+		return c.applyMigration(ctx, tx, meta, m)
+	} else if err := tx.Exec(ctx, "SAVEPOINT pgmigrate"); err != nil {
+		return 0, err
+	}
+	d, err := c.applyMigration(ctx, tx, meta, m)
+	if err != nil {
+		if rbErr := tx.Exec(ctx, "ROLLBACK TO SAVEPOINT pgmigrate"); rbErr != nil {
+			return 0, fmt.Errorf("%w (rollback to savepoint failed: %s)", err, rbErr)
+		}
+		return 0, err
+	}
+	return d, tx.Exec(ctx, "RELEASE SAVEPOINT pgmigrate")
+}
+
+// applyMigrationsPerTx applies each of ms to the db in its own transaction
+// and returns the results or an error that includes the number of migrations
+// that were applied before the failure.
+func (c *Config) applyMigrationsPerTx(ctx context.Context, db, meta DB, ms Migrations) ([]Result, error) {
+	results := make([]Result, 0, len(ms))
+	for i, m := range ms {
+		c.progress(i, len(ms), m)
+		d, err := c.applyMigrationTx(ctx, db, meta, m)
+		if err != nil {
+			return nil, fmt.Errorf("%d of %d migrations applied: %w", i, len(ms), err)
+		}
+		results = append(results, Result{Migration: m, Duration: d})
+	}
+	return results, nil
+}
+
+// applyMigrationTx applies m to the db in its own transaction, or directly
+// against the db if m is NoTransaction. If MetaDB is configured, m is
+// recorded in a separate transaction of meta.
+func (c *Config) applyMigrationTx(ctx context.Context, db, meta DB, m Migration) (time.Duration, error) {
+	start := c.now()
+	if m.NoTransaction {
+		d, err := c.applyMigration(ctx, db, meta, m)
+		if err != nil {
+			return 0, err
+		}
+		return d, c.store(ctx, c.appliedMigration(m, d, start))
+	}
+	tx, err := c.beginTx(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	metaTx := tx
+	if c.MetaDB != nil {
+		if metaTx, err = meta.Begin(ctx); err != nil {
+			return 0, err
+		}
+		defer metaTx.Rollback()
+	}
+	d, err := c.applyMigration(ctx, tx, metaTx, m)
+	if err != nil {
+		return 0, err
+	} else if err := c.commit(tx, metaTx); err != nil {
+		return 0, err
+	}
+	return d, c.store(ctx, c.appliedMigration(m, d, start))
+}
+
+// applyMigration executes m using q and records it in the migrations table
+// using meta, and returns the time it took to execute m or an error. The
+// outcome is reported to the configured Metrics and Logger.
+func (c *Config) applyMigration(ctx context.Context, q, meta Querier, m Migration) (time.Duration, error) {
+	c.logger().Printf("applying migration %d %s", m.ID, m.Description)
+	finish := c.tracer().StartSpan(fmt.Sprintf("pgmigrate.migration %d %s", m.ID, m.Description))
+	d, err := c.runMigration(ctx, q, meta, m)
+	finish(err)
+	if err != nil {
+		c.logger().Printf("migration %d %s failed: %s", m.ID, m.Description, err)
+		c.metrics().MigrationFailed(m.ID, err)
+		return 0, err
+	}
+	c.logger().Printf("applied migration %d %s in %s", m.ID, m.Description, d)
+	c.metrics().MigrationApplied(m.ID, d)
+	return d, nil
+}
+
+// metrics returns the configured Metrics, or a no-op implementation.
+func (c *Config) metrics() Metrics {
+	if c.Metrics == nil {
+		return nopMetrics{}
+	}
+	return c.Metrics
+}
+
+// tracer returns the configured Tracer, or a no-op implementation.
+func (c *Config) tracer() Tracer {
+	if c.Tracer == nil {
+		return nopTracer{}
+	}
+	return c.Tracer
+}
+
+// now returns the current time using the configured Now func, or time.Now.
+func (c *Config) now() time.Time {
+	if c.Now == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
+
+// logger returns the configured Logger, or a no-op implementation.
+func (c *Config) logger() Logger {
+	if c.Logger == nil {
+		return nopLogger{}
+	}
+	return c.Logger
+}
+
+// runMigration executes m using q and records it in the migrations table
+// using meta, and returns the time it took to execute m or an error. Only the
+// sha256 hash of the sql of m is stored in the db.
+func (c *Config) runMigration(ctx context.Context, q, meta Querier, m Migration) (time.Duration, error) {
+	start, duration, err := c.execMigration(ctx, q, m)
+	if err != nil {
+		return 0, err
+	} else if c.Store != nil {
+		return duration, nil
+	} else if err := c.record(ctx, meta, m, duration, start); err != nil {
+		return 0, fmt.Errorf("%d %s: %w", m.ID, m.Description, err)
+	}
+	return duration, nil
+}
+
+// execMigration executes m without recording it in the migrations table, and
+// returns the time it started at and took, or an error.
+func (c *Config) execMigration(ctx context.Context, q Querier, m Migration) (time.Time, time.Duration, error) {
+	if !m.NoTransaction {
+		if err := c.setLocal(ctx, q); err != nil {
+			return time.Time{}, 0, fmt.Errorf("%d %s: %w", m.ID, m.Description, err)
+		}
+	}
+	sql, err := c.prepareSQL(m)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("%d %s: %w", m.ID, m.Description, err)
+	}
+	if m.PrecheckSQL != "" {
+		ok, err := precheck(ctx, q, m.PrecheckSQL)
+		if err != nil {
+			return time.Time{}, 0, fmt.Errorf("%d %s: precheck: %w", m.ID, m.Description, err)
+		} else if !ok {
+			c.logger().Printf("skipping migration %d %s, because its precheck returned false", m.ID, m.Description)
+			return c.now(), 0, nil
+		}
+	}
+	if c.BeforeMigration != nil {
+		c.BeforeMigration(m)
+	}
+	start := c.now()
+	if m.Func != nil {
+		err = m.Func(ctx, q)
+	} else {
+		err = c.exec(ctx, q, sql)
+	}
+	duration := c.now().Sub(start)
+	if c.AfterMigration != nil {
+		c.AfterMigration(m, duration, err)
+	}
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("%d %s: %w", m.ID, m.Description, err)
+	}
+	return start, duration, nil
+}
+
+// precheck executes the PrecheckSQL sql using q and returns its result, or an
+// error if it doesn't return a single boolean.
+func precheck(ctx context.Context, q Querier, sql string) (bool, error) {
+	rows, err := q.Query(ctx, sql)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	var ok bool
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return false, err
+		}
+		return false, errors.New("no rows returned")
+	} else if err := rows.Scan(&ok); err != nil {
+		return false, err
+	} else if rows.Next() {
+		return false, errors.New("more than one row returned")
+	}
+	return ok, rows.Err()
+}
+
+// record inserts m into the migrations table, or returns an error. For Func
+// migrations the name of the function is stored in the sql column, which is
+// otherwise left empty.
+func (c *Config) record(ctx context.Context, q Querier, m Migration, duration time.Duration, created time.Time) error {
+	col := c.columns()
+	values := []string{"$1", "$2", "$3", "$4", "$5", "$6", "COALESCE(NULLIF($7::text, ''), current_user)", "NULLIF($8::text, '')"}
+	args := []interface{}{m.ID, m.Description, recordedSQL(m), sha256Hex(m.SQL), c.durationValue(duration), created.UTC(), c.AppliedBy, c.Revision}
+	if c.CompressSQL {
+		compressed, err := compressSQL(m.SQL)
+		if err != nil {
+			return err
+		}
+		values, args = append(values, "$9"), append(args, compressed)
+	}
+	sql := c.recordSQL(values...) + " ON CONFLICT (" + col.id + ") DO NOTHING RETURNING " + col.id
+	rows, err := q.Query(ctx, sql, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("migration %d has already been recorded, possibly by a concurrent migration", m.ID)
+	}
+	return rows.Close()
+}
+
+// recordSQL returns the INSERT statement of record with the given value
+// expressions for the id, description, sql, sha256, duration, created,
+// applied_by and revision columns, followed by the sql_gzip column if
+// CompressSQL is enabled.
+func (c *Config) recordSQL(values ...string) string {
+	col := c.columns()
+	names := col.id + ", " + col.description + ", " + col.sql + ", " + col.sha256 + ", " + col.duration + ", " + col.created + ", " + col.appliedBy + ", " + col.revision
+	if c.CompressSQL {
+		names += ", " + col.sqlGzip
+	}
+	return "INSERT INTO " + c.table() + " (" + names + ") VALUES (" + strings.Join(values, ", ") + ")"
+}
+
+// compressSQL returns sql gzip compressed, or nil if sql is empty, e.g. for
+// Func migrations.
+func compressSQL(sql string) ([]byte, error) {
+	if sql == "" {
+		return nil, nil
+	}
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := io.WriteString(w, sql); err != nil {
+		return nil, err
+	} else if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// decompressSQL returns the sql compressed by compressSQL, or an error.
+func decompressSQL(data []byte) (string, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	sql, err := io.ReadAll(r)
+	return string(sql), err
+}
+
+// recordedSQL returns the value of the sql column for m, which is the name of
+// the function for Func migrations, or empty otherwise.
+func recordedSQL(m Migration) string {
+	if m.Func == nil {
+		return ""
+	}
+	return "-- func " + runtime.FuncForPC(reflect.ValueOf(m.Func).Pointer()).Name()
+}
+
+// durationValue returns d as a value for the duration column.
+func (c *Config) durationValue(d time.Duration) interface{} {
+	if c.DurationColumnType == DurationMilliseconds {
+		return d.Milliseconds()
+	}
+	return d.Seconds()
+}
+
+// durationType returns the postgres type of the duration column.
+func (c *Config) durationType() string {
+	if c.DurationColumnType == DurationMilliseconds {
+		return "bigint"
+	}
+	return "interval"
+}
+
+// durationSeconds returns an SQL expression that selects the duration column
+// in seconds.
+func (c *Config) durationSeconds() string {
+	if c.DurationColumnType == DurationMilliseconds {
+		return c.columns().duration + " / 1000.0"
+	}
+	return "extract(epoch FROM " + c.columns().duration + ")"
+}
+
+// prepareSQL returns the SQL that needs to be executed for m, or an error.
+func (c *Config) prepareSQL(m Migration) (string, error) {
+	if c.RenderTemplates && m.Func == nil {
+		var err error
+		if m.SQL, err = c.renderTemplate(m); err != nil {
+			return "", err
+		}
+	}
+	if c.Vars != nil {
+		var err error
+		if m.SQL, err = expandVars(m.SQL, c.Vars); err != nil {
+			return "", err
+		}
+	}
+	if c.RewriteSQL == nil || m.Func != nil {
+		return m.SQL, nil
+	}
+	sql, err := c.RewriteSQL(m)
+	if err != nil {
+		return "", fmt.Errorf("rewrite sql: %w", err)
+	}
+	return sql, nil
+}
+
+// prepareDownSQL is like prepareSQL, but returns the DownSQL that needs to be
+// executed for reverting m.
+func (c *Config) prepareDownSQL(m Migration) (string, error) {
+	m.SQL, m.Func = m.DownSQL, nil
+	return c.prepareSQL(m)
+}
+
+// renderTemplate returns the SQL of m rendered as a text/template, see
+// RenderTemplates, or an error.
+func (c *Config) renderTemplate(m Migration) (string, error) {
+	tmpl, err := template.New(m.Description).Option("missingkey=error").Parse(m.SQL)
+	if err != nil {
+		return "", fmt.Errorf("parse template: %w", err)
+	}
+	data := struct {
+		Schema string
+		Table  string
+		Vars   map[string]string
+	}{c.Schema, c.Table, c.Vars}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("render template: %w", err)
+	}
+	return b.String(), nil
+}
+
+// expandVars replaces all ${NAME} placeholders in sql with their value from
+// vars and all $${ with ${, or returns an error if a placeholder has no
+// value.
+func expandVars(sql string, vars map[string]string) (string, error) {
+	var err error
+	sql = varRegexp.ReplaceAllStringFunc(sql, func(match string) string {
+		if match == "$${" {
+			return "${"
+		}
+		name := match[2 : len(match)-1]
+		val, ok := vars[name]
+		if !ok && err == nil {
+			err = fmt.Errorf("unknown variable: %s", name)
+		}
+		return val
+	})
+	return sql, err
+}
+
+// exec executes sql, or each of its statements if SplitStatements is true.
+func (c *Config) exec(ctx context.Context, q Querier, sql string) error {
+	if !c.SplitStatements {
+		if err := q.Exec(ctx, sql); err != nil {
+			return &ExecError{SQL: sql, Position: errorPosition(err), Err: err}
+		}
+		return nil
+	}
+	for i, stmt := range splitStatements(sql) {
+		if err := q.Exec(ctx, stmt); err != nil {
+			return &ExecError{Statement: i + 1, SQL: stmt, Position: errorPosition(err), Err: err}
+		}
+	}
+	return nil
+}
+
+// ExecError is returned if executing the SQL of a migration fails.
+type ExecError struct {
+	// Statement is the 1-based index of the failed statement if
+	// Config.SplitStatements is enabled, or 0 otherwise.
+	Statement int
+	// SQL is the failed statement if Config.SplitStatements is enabled, or
+	// the SQL of the migration otherwise.
+	SQL string
+	// Position is the 1-based character position of the error in SQL as
+	// reported by the driver, e.g. pq.Error.Position, or 0 if it's unknown.
+	Position int
+	// Err is the error returned by the driver.
+	Err error
+}
+
+// Error is part of the error interface. It includes the line of the error
+// and an excerpt of the SQL starting at this line, or the beginning of the
+// SQL if the position is unknown.
+func (e *ExecError) Error() string {
+	var msg string
+	if e.Statement > 0 {
+		msg = fmt.Sprintf("statement %d: ", e.Statement)
+	}
+	msg += e.Err.Error()
+	excerpt := e.SQL
+	if runes := []rune(e.SQL); e.Position > 0 && e.Position <= len(runes) {
+		// The position counts characters, so the line is located in runes
+		// rather than bytes, which also works for SQL that is not valid
+		// UTF-8.
+		before := runes[:e.Position-1]
+		start := 0
+		for i, r := range before {
+			if r == '\n' {
+				start = i + 1
+			}
+		}
+		msg += fmt.Sprintf(" at line %d", strings.Count(string(before), "\n")+1)
+		excerpt = string(runes[start:])
+	}
+	return msg + fmt.Sprintf(": %q", truncate(excerpt, 200))
+}
+
+// Unwrap returns the error returned by the driver.
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+// errorPosition returns the error position of the first error in the chain
+// of err that has a Position field, or 0. This supports the errors of lib/pq
+// and pgx without depending on them.
+func errorPosition(err error) int {
+	for ; err != nil; err = errors.Unwrap(err) {
+		v := reflect.Indirect(reflect.ValueOf(err))
+		if v.Kind() != reflect.Struct {
+			continue
+		}
+		f := v.FieldByName("Position")
+		switch f.Kind() {
+		case reflect.String:
+			if pos, err := strconv.Atoi(f.String()); err == nil {
+				return pos
+			}
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return int(f.Int())
+		}
+	}
+	return 0
+}
+
+// setLocal configures the current transaction for executing a migration
+// using SET LOCAL, so the settings don't leak into other transactions.
+func (c *Config) setLocal(ctx context.Context, q Querier) error {
+	for _, sql := range c.setLocalSQL() {
+		if err := q.Exec(ctx, sql); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setLocalSQL returns the SET LOCAL statements executed by setLocal.
+func (c *Config) setLocalSQL() []string {
+	var stmts []string
+	if c.StatementTimeout > 0 {
+		stmts = append(stmts, fmt.Sprintf("SET LOCAL statement_timeout = %d", timeoutMilliseconds(c.StatementTimeout)))
+	}
+	if c.StatementLockTimeout > 0 {
+		stmts = append(stmts, fmt.Sprintf("SET LOCAL lock_timeout = %d", timeoutMilliseconds(c.StatementLockTimeout)))
+	}
+	if len(c.SearchPath) > 0 {
+		schemas := make([]string, len(c.SearchPath))
+		for i, schema := range c.SearchPath {
+			schemas[i] = quoteIdentifier(schema)
+		}
+		stmts = append(stmts, "SET LOCAL search_path = "+strings.Join(schemas, ", "))
+	}
+	return stmts
+}
+
+// timeoutMilliseconds returns d in milliseconds rounded up, so a positive d
+// below 1ms doesn't turn into 0, which disables the timeout.
+func timeoutMilliseconds(d time.Duration) int64 {
+	return int64((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+// rollbackMigrations reverts ms in the given order and returns them or an
+// error. The migrations are reverted in tx, unless any of them is
+// NoTransaction, in which case tx is committed and each migration is reverted
+// in its own transaction of db, or directly against db if it's NoTransaction.
+func (c *Config) rollbackMigrations(ctx context.Context, db DB, tx Tx, ms Migrations) (Migrations, error) {
+	if !ms.noTransaction() {
+		for _, m := range ms {
+			if err := c.rollbackMigration(ctx, tx, m); err != nil {
+				return nil, err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return ms, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	for i, m := range ms {
+		if err := c.rollbackMigrationTx(ctx, db, m); err != nil {
+			return nil, fmt.Errorf("%d of %d migrations rolled back: %w", i, len(ms), err)
+		}
+	}
+	return ms, nil
+}
+
+// rollbackMigrationTx reverts m in its own transaction, or directly against
+// db if m is NoTransaction.
+func (c *Config) rollbackMigrationTx(ctx context.Context, db DB, m Migration) error {
+	if m.NoTransaction {
+		return c.rollbackMigration(ctx, db, m)
+	}
+	tx, err := c.beginTx(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := c.rollbackMigration(ctx, tx, m); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// rollbackMigration executes the DownSQL of m using q the same way
+// execMigration executes its SQL, and deletes m from the migrations table.
+func (c *Config) rollbackMigration(ctx context.Context, q Querier, m Migration) error {
+	if !m.NoTransaction {
+		if err := c.setLocal(ctx, q); err != nil {
+			return fmt.Errorf("%d %s: %w", m.ID, m.Description, err)
+		}
+	}
+	sql, err := c.prepareDownSQL(m)
+	if err != nil {
+		return fmt.Errorf("%d %s: %w", m.ID, m.Description, err)
+	} else if err := c.exec(ctx, q, sql); err != nil {
+		return fmt.Errorf("%d %s: %w", m.ID, m.Description, err)
+	}
+	del := "DELETE FROM " + c.table() + " WHERE " + c.columns().id + " = $1"
+	if err := q.Exec(ctx, del, m.ID); err != nil {
+		return fmt.Errorf("%d %s: %w", m.ID, m.Description, err)
+	}
+	c.logger().Printf("rolled back migration %d %s", m.ID, m.Description)
+	return nil
+}
+
+// sha256Hex returns the hex encoded sha256 hash of s. It's identical to
+// encode(sha256(s), 'hex') in postgres.
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// quoteIdentifier quotes name to be used as an identifier in a postgres SQL
+// query. The implementation is copied from lib/pq.
 func quoteIdentifier(name string) string {
 	end := strings.IndexRune(name, 0)
 	if end > -1 {
@@ -221,3 +3698,13 @@ func quoteIdentifier(name string) string {
 	}
 	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
 }
+
+// quoteLiteral quotes s to be used as a string literal in a postgres SQL
+// query. The implementation is copied from lib/pq.
+func quoteLiteral(s string) string {
+	s = strings.Replace(s, `'`, `''`, -1)
+	if strings.Contains(s, `\`) {
+		return ` E'` + strings.Replace(s, `\`, `\\`, -1) + `'`
+	}
+	return `'` + s + `'`
+}
@@ -1,18 +1,26 @@
 package pgmigrate
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io/fs"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"sort"
 	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 func TestLoadMigrations(t *testing.T) {
@@ -42,6 +50,455 @@ func TestLoadMigrations(t *testing.T) {
 	if !reflect.DeepEqual(want, got) {
 		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, want)
 	}
+	if got, err := LoadMigrationsDir(dir); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(want, got) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, want)
+	}
+	if _, err := LoadMigrationsDir(filepath.Join(dir, "does-not-exist")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestLoadMigrationsMulti(t *testing.T) {
+	var dirs []http.FileSystem
+	for _, files := range []map[string]string{
+		{"1_foo.sql": "SELECT 1", "3_baz.sql": "SELECT 3"},
+		{"2_bar.up.sql": "SELECT 2", "2_bar.down.sql": "SELECT -2"},
+	} {
+		dir, err := ioutil.TempDir("", "pgmigrate")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		for name, sql := range files {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(sql), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		dirs = append(dirs, http.Dir(dir))
+	}
+	got, err := LoadMigrationsMulti(dirs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_bar.up.sql", SQL: "SELECT 2", DownSQL: "SELECT -2"},
+		{ID: 3, Description: "3_baz.sql", SQL: "SELECT 3"},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, want)
+	}
+
+	_, err = LoadMigrationsMulti(dirs[0], dirs[1], dirs[0])
+	want1 := fmt.Sprintf("duplicate migration id 1 in %s and %s", dirs[0], dirs[0])
+	if err := checkErr(err, want1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadMigrationsFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1_foo.sql":   {Data: []byte("SELECT 1")},
+		"2_bar.sql":   {Data: []byte("SELECT 2")},
+		"10_sort.sql": {Data: []byte("SELECT 10")},
+		"invalid.sql": {Data: []byte("SELECT 3")},
+	}
+	got, err := LoadMigrationsFS(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2"},
+		{ID: 10, Description: "10_sort.sql", SQL: "SELECT 10"},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, want)
+	}
+}
+
+func TestLoadMigrationsFSDir(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/1_foo.sql":          {Data: []byte("SELECT 1")},
+		"migrations/2_bar.sql":          {Data: []byte("SELECT 2")},
+		"migrations/invalid.sql":        {Data: []byte("SELECT 3")},
+		"migrations/3_nested.sql/4.sql": {Data: []byte("SELECT 4")},
+		"migrations/old/3_baz.sql":      {Data: []byte("SELECT 3")},
+		"5_other.sql":                   {Data: []byte("SELECT 5")},
+	}
+	want := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2"},
+	}
+	got, err := LoadMigrationsFSDir(fsys, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(want, got) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, want)
+	}
+	sub, err := fs.Sub(fsys, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	} else if got, err := LoadMigrationsFS(sub); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(want, got) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, want)
+	}
+}
+
+func TestLoadMigrationsFS_down(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1_foo.up.sql":   {Data: []byte("CREATE TABLE foo();")},
+		"1_foo.down.sql": {Data: []byte("DROP TABLE foo;")},
+		"2_bar.sql":      {Data: []byte("SELECT 2")},
+	}
+	got, err := LoadMigrationsFS(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Migrations{
+		{ID: 1, Description: "1_foo.up.sql", SQL: "CREATE TABLE foo();", DownSQL: "DROP TABLE foo;"},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2"},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, want)
+	}
+
+	fsys["3_baz.down.sql"] = &fstest.MapFile{Data: []byte("SELECT 3")}
+	_, err = LoadMigrationsFS(fsys)
+	if err := checkErr(err, "down migration without up migration: 3_baz.down.sql"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadMigrationsFS_directives(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1_foo.sql": {Data: []byte("-- pgmigrate:no-transaction\nCREATE INDEX CONCURRENTLY foo_idx ON foo (id);")},
+		"2_bar.sql": {Data: []byte("SELECT 2;\n-- pgmigrate:no-transaction")},
+		"3_baz.sql": {Data: []byte("-- pgmigrate:allow-modification\n-- pgmigrate:tags schema, backfill\nSELECT 3;")},
+	}
+	got, err := LoadMigrationsFS(fsys)
+	if err != nil {
+		t.Fatal(err)
+	} else if !got[0].NoTransaction {
+		t.Fatal("expected NoTransaction for directive at the top")
+	} else if got[1].NoTransaction {
+		t.Fatal("unexpected NoTransaction for directive after the first statement")
+	} else if got[0].AllowModified || !got[2].AllowModified {
+		t.Fatal("expected AllowModified for allow-modification directive only")
+	} else if want := []string{"schema", "backfill"}; !reflect.DeepEqual(got[2].Tags, want) || got[0].Tags != nil {
+		t.Fatalf("got=%q want=%q", got[2].Tags, want)
+	}
+
+	fsys["4_qux.sql"] = &fstest.MapFile{Data: []byte("-- pgmigrate:min-version 15\nSELECT 4;")}
+	if got, err = LoadMigrationsFS(fsys); err != nil {
+		t.Fatal(err)
+	} else if got[3].MinVersion != 15 || got[2].MinVersion != 0 {
+		t.Fatalf("unexpected min versions: %d %d", got[3].MinVersion, got[2].MinVersion)
+	}
+	fsys["4_qux.sql"] = &fstest.MapFile{Data: []byte("-- pgmigrate:min-version x\nSELECT 4;")}
+	_, err = LoadMigrationsFS(fsys)
+	if err := checkErr(err, `bad directive: 4_qux.sql: bad min-version "x"`); err != nil {
+		t.Fatal(err)
+	}
+	fsys["4_qux.sql"] = &fstest.MapFile{Data: []byte("-- pgmigrate:precheck SELECT count(*) < 1000 FROM users\nSELECT 4;")}
+	if got, err = LoadMigrationsFS(fsys); err != nil {
+		t.Fatal(err)
+	} else if want := "SELECT count(*) < 1000 FROM users"; got[3].PrecheckSQL != want {
+		t.Fatalf("got=%q want=%q", got[3].PrecheckSQL, want)
+	}
+	fsys["4_qux.sql"] = &fstest.MapFile{Data: []byte("-- pgmigrate:breaking\nALTER TABLE users DROP COLUMN name;")}
+	if got, err = LoadMigrationsFS(fsys); err != nil {
+		t.Fatal(err)
+	} else if !got[3].Breaking || got[2].Breaking {
+		t.Fatal("expected Breaking for breaking directive only")
+	}
+	fsys["4_qux.sql"] = &fstest.MapFile{Data: []byte("-- pgmigrate:precheck\nSELECT 4;")}
+	_, err = LoadMigrationsFS(fsys)
+	if err := checkErr(err, "bad directive: 4_qux.sql: missing precheck sql"); err != nil {
+		t.Fatal(err)
+	}
+	fsys["4_qux.sql"] = &fstest.MapFile{Data: []byte("-- pgmigrate:tags\nSELECT 4;")}
+	_, err = LoadMigrationsFS(fsys)
+	if err := checkErr(err, "bad directive: 4_qux.sql: missing tags"); err != nil {
+		t.Fatal(err)
+	}
+	fsys["4_qux.sql"] = &fstest.MapFile{Data: []byte("-- pgmigrate: breaking\n--pgmigrate:  no-transaction\nSELECT 4;")}
+	if got, err = LoadMigrationsFS(fsys); err != nil {
+		t.Fatal(err)
+	} else if !got[3].Breaking || !got[3].NoTransaction {
+		t.Fatal("expected Breaking and NoTransaction for spaced directives")
+	}
+	fsys["4_qux.sql"] = &fstest.MapFile{Data: []byte("-- pgmigrate:\nSELECT 4;")}
+	_, err = LoadMigrationsFS(fsys)
+	if err := checkErr(err, "bad directive: 4_qux.sql: missing directive"); err != nil {
+		t.Fatal(err)
+	}
+	fsys["4_qux.sql"] = &fstest.MapFile{Data: []byte("-- pgmigrate:bad\nSELECT 4;")}
+	_, err = LoadMigrationsFS(fsys)
+	if err := checkErr(err, `bad directive: 4_qux.sql: unknown directive "bad"`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadMigrationsFS_timestamps(t *testing.T) {
+	fsys := fstest.MapFS{
+		"20240115093000_add_users.sql": {Data: []byte("SELECT 1")},
+		"20240201120000_add_posts.sql": {Data: []byte("SELECT 2")},
+	}
+	got, err := LoadMigrationsFS(fsys)
+	if err != nil {
+		t.Fatal(err)
+	} else if want := []int64{20240115093000, 20240201120000}; !reflect.DeepEqual(got.IDs(), want) {
+		t.Fatalf("got=%v want=%v", got.IDs(), want)
+	} else if err := got.valid(true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadMigrationsFromMap_outOfRange(t *testing.T) {
+	_, err := LoadMigrationsFromMap(map[string]string{"999999999999999999999_x.sql": "SELECT 1"})
+	if err := checkErr(err, "migration id out of range: 999999999999999999999_x.sql"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadOptions_extension(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1_foo.sql.tmpl":      {Data: []byte("SELECT {{.One}}")},
+		"1_foo.down.sql.tmpl": {Data: []byte("SELECT -{{.One}}")},
+		"2_bar.sql":           {Data: []byte("SELECT 2")},
+		"3_baz.sqlxtmpl":      {Data: []byte("SELECT 3")},
+	}
+	got, err := LoadOptions{Extension: ".sql.tmpl"}.LoadMigrationsFS(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Migrations{{ID: 1, Description: "1_foo.sql.tmpl", SQL: "SELECT {{.One}}", DownSQL: "SELECT -{{.One}}"}}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, want)
+	}
+}
+
+func TestLoadOptions_exclude(t *testing.T) {
+	files := map[string]string{
+		"1_foo.sql":          "SELECT 1",
+		"1_fixture.test.sql": "INSERT INTO foo VALUES (1)",
+		"2_bar.sql":          "SELECT 2",
+	}
+	got, err := LoadOptions{Exclude: []string{"*.test.sql"}}.LoadMigrationsFromMap(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Migrations{{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"}, {ID: 2, Description: "2_bar.sql", SQL: "SELECT 2"}}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, want)
+	}
+	_, err = LoadOptions{Exclude: []string{"["}}.LoadMigrationsFromMap(files)
+	if err := checkErr(err, `bad exclude pattern "[": syntax error in pattern`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadMigrationsFromMap_encoding(t *testing.T) {
+	got, err := LoadMigrationsFromMap(map[string]string{"1_foo.sql": "\ufeffSELECT 1"})
+	if err != nil {
+		t.Fatal(err)
+	} else if want := (Migrations{{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"}}); !reflect.DeepEqual(want, got) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, want)
+	}
+	_, err = LoadMigrationsFromMap(map[string]string{"1_foo.sql": "SELECT '\xff'"})
+	if err := checkErr(err, "migration 1_foo.sql is not valid UTF-8"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadMigrationsFromReader(strings.NewReader("-- migration: 1 foo\nSELECT '\xff'"))
+	if err := checkErr(err, "migrations are not valid UTF-8"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadMigrationsFromReader(t *testing.T) {
+	schema := `-- generated schema
+
+-- migration: 1 create_users
+CREATE TABLE users (id int);
+-- migration: 2 add_email
+-- pgmigrate:no-transaction
+CREATE INDEX CONCURRENTLY users_id_idx ON users (id);
+`
+	got, err := LoadMigrationsFromReader(strings.NewReader(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Migrations{
+		{ID: 1, Description: "create_users", SQL: "CREATE TABLE users (id int);\n"},
+		{ID: 2, Description: "add_email", SQL: "-- pgmigrate:no-transaction\nCREATE INDEX CONCURRENTLY users_id_idx ON users (id);\n", NoTransaction: true},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, want)
+	}
+
+	got, err = LoadOptions{Marker: "--- "}.LoadMigrationsFromReader(strings.NewReader("--- 1 foo\nSELECT 1"))
+	if err != nil {
+		t.Fatal(err)
+	} else if want := (Migrations{{ID: 1, Description: "foo", SQL: "SELECT 1"}}); !reflect.DeepEqual(want, got) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, want)
+	}
+	_, err = LoadOptions{Marker: "-- migrate:"}.LoadMigrationsFromReader(strings.NewReader(schema))
+	if err := checkErr(err, "sql before first migration marker"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = LoadMigrationsFromReader(strings.NewReader("-- nothing yet\n")); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 0 {
+		t.Fatalf("got=%d want=0", len(got))
+	}
+
+	tests := []struct {
+		SQL     string
+		WantErr string
+	}{
+		{"SELECT 0;\n-- migration: 1 foo\nSELECT 1", "sql before first migration marker"},
+		{"SELECT 0;\n", "sql before first migration marker"},
+		{"-- migration: 1\nSELECT 1", `bad marker on line 1: "-- migration: 1"`},
+		{"-- migration: x foo\nSELECT 1", "bad id: foo"},
+	}
+	for _, test := range tests {
+		_, err := LoadMigrationsFromReader(strings.NewReader(test.SQL))
+		if err := checkErr(err, test.WantErr); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestMustLoadMigrationsFS(t *testing.T) {
+	fsys := fstest.MapFS{"1_foo.sql": {Data: []byte("SELECT 1")}}
+	if ms := MustLoadMigrationsFS(fsys); len(ms) != 1 {
+		t.Fatalf("got=%d want=1", len(ms))
+	}
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("expected panic")
+		} else if err := checkErr(fmt.Errorf("%v", r), "down migration without up migration"); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	fsys["2_bar.down.sql"] = &fstest.MapFile{Data: []byte("SELECT 2")}
+	MustLoadMigrationsFS(fsys)
+}
+
+func TestLoadMigrationsFromMap(t *testing.T) {
+	got, err := LoadMigrationsFromMap(map[string]string{
+		"10_sort.sql":    "SELECT 10",
+		"1_foo.up.sql":   "-- pgmigrate:no-transaction\nSELECT 1",
+		"1_foo.down.sql": "SELECT -1",
+		"2_bar.sql":      "SELECT 2",
+		"invalid.sql":    "SELECT 3",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Migrations{
+		{ID: 1, Description: "1_foo.up.sql", SQL: "-- pgmigrate:no-transaction\nSELECT 1", DownSQL: "SELECT -1", NoTransaction: true},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2"},
+		{ID: 10, Description: "10_sort.sql", SQL: "SELECT 10"},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, want)
+	}
+}
+
+func TestLoadMigrationsFS_duplicates(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1_foo.sql":  {Data: []byte("SELECT 1")},
+		"01_bar.sql": {Data: []byte("SELECT 2")},
+	}
+	ms, err := LoadMigrationsFS(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkErr(ms.Valid(), "duplicate migration id 1: 01_bar.sql and 1_foo.sql"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrations_Less(t *testing.T) {
+	for _, ms := range []Migrations{
+		{{ID: 2, Description: "2_x.sql", SQL: "SELECT 2"}, {ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"}, {ID: 1, Description: "1_bar.sql", SQL: "SELECT 1"}},
+		{{ID: 1, Description: "1_bar.sql", SQL: "SELECT 1"}, {ID: 2, Description: "2_x.sql", SQL: "SELECT 2"}, {ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"}},
+	} {
+		sort.Sort(ms)
+		if err := checkErr(ms.Valid(), "duplicate migration id 1: 1_bar.sql and 1_foo.sql"); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestMigration_Checksum(t *testing.T) {
+	m := Migration{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"}
+	if got, want := m.Checksum(), "e004ebd5b5532a4b85984a62f8ad48a81aa3460c1ca07701f386135d72cdecf5"; got != want {
+		t.Fatalf("got=%s want=%s", got, want)
+	}
+	sum := m.Checksum()
+	if m.DownSQL = "SELECT -1"; m.Checksum() == sum {
+		t.Fatal("expected DownSQL to change the checksum")
+	}
+}
+
+func TestMigrations_SetChecksum(t *testing.T) {
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2"},
+	}
+	sum := ms.SetChecksum()
+	if got := (Migrations{}).SetChecksum(); got == sum || len(got) != 64 {
+		t.Fatalf("unexpected checksum of empty set: %s", got)
+	}
+	renamed := Migrations{ms[0], ms[1]}
+	renamed[1].Description = "2_baz.sql"
+	modified := Migrations{ms[0], ms[1]}
+	modified[1].SQL = "SELECT 3"
+	for _, other := range []Migrations{renamed, modified, ms[:1]} {
+		if other.SetChecksum() == sum {
+			t.Errorf("expected %v to change the checksum", other)
+		}
+	}
+	if got := (Migrations{ms[0], ms[1]}).SetChecksum(); got != sum {
+		t.Fatalf("got=%s want=%s", got, sum)
+	}
+}
+
+func TestMigrations_json(t *testing.T) {
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1", DownSQL: "SELECT -1"},
+		{ID: 2, Description: "2_bar.sql", NoTransaction: true},
+	}
+	got, err := json.Marshal(ms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"id":1,"description":"1_foo.sql","sql":"SELECT 1","down_sql":"SELECT -1"},{"id":2,"description":"2_bar.sql","no_transaction":true}]`
+	if string(got) != want {
+		t.Fatalf("\ngot:  %s\nwant: %s", got, want)
+	}
+
+	statuses := []MigrationStatus{{ID: 1, Description: "1_foo.sql", State: Modified}}
+	if got, err = json.Marshal(statuses); err != nil {
+		t.Fatal(err)
+	} else if want := `[{"id":1,"description":"1_foo.sql","state":"modified"}]`; string(got) != want {
+		t.Fatalf("\ngot:  %s\nwant: %s", got, want)
+	}
+	var decoded []MigrationStatus
+	if err := json.Unmarshal(got, &decoded); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(decoded, statuses) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", decoded, statuses)
+	}
+	if _, err := json.Marshal(MigrationState(42)); err == nil {
+		t.Fatal("expected error for invalid state")
+	}
 }
 
 func TestMigrations_sorting(t *testing.T) {
@@ -70,6 +527,10 @@ func TestMigrations_valid(t *testing.T) {
 			Migrations{{ID: 1, Description: "foo"}},
 			"missing sql",
 		},
+		{
+			Migrations{{ID: 1, Description: "foo", SQL: " \n-- TODO\n/* later */;\n"}},
+			"invalid migration 1: contains no executable SQL",
+		},
 		{
 			Migrations{{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"}},
 			"",
@@ -93,7 +554,21 @@ func TestMigrations_valid(t *testing.T) {
 				{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
 				{ID: 1, Description: "1_bar.sql", SQL: "SELECT 3"},
 			},
-			"unexpected migration id: got=1 want=2",
+			"duplicate migration id 1: 1_foo.sql and 1_bar.sql",
+		},
+		{
+			Migrations{
+				{ID: 1, Description: "1_foo.go", Func: func(context.Context, Querier) error { return nil }},
+				{ID: 2, Description: "2_bar.go", SQL: "SELECT 2", Func: func(context.Context, Querier) error { return nil }},
+			},
+			"invalid migration 2: has both sql and func",
+		},
+		{
+			Migrations{
+				{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+				{ID: 2, Description: "3_bar.sql", SQL: "SELECT 2"},
+			},
+			"invalid migration 2: id 2 does not match file name 3_bar.sql",
 		},
 	}
 	for _, test := range tests {
@@ -104,33 +579,591 @@ func TestMigrations_valid(t *testing.T) {
 	}
 }
 
-func TestConfig_Migrate(t *testing.T) {
-	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
-	if err != nil {
+func TestMigrations_MustValid(t *testing.T) {
+	Migrations{{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"}}.MustValid()
+	defer func() {
+		if err := checkErr(fmt.Errorf("%v", recover()), "pgmigrate: invalid migration 1: missing sql"); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	Migrations{{ID: 1, Description: "1_foo.sql"}}.MustValid()
+}
+
+func TestDescriptionPattern(t *testing.T) {
+	c := Config{DescriptionPattern: regexp.MustCompile(`^\d+_[a-z]+_[a-z_]+\.sql$`)}
+	ms := Migrations{
+		{ID: 1, Description: "1_create_users.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_Users.sql", SQL: "SELECT 2"},
+	}
+	if err := c.validate(ms[:1]); err != nil {
+		t.Fatal(err)
+	}
+	err := c.validate(ms)
+	if err := checkErr(err, `invalid migration 2: description "2_Users.sql" does not match`); err != nil {
 		t.Fatal(err)
 	}
+	c.DescriptionPattern = nil
+	if err := c.validate(ms); err != nil {
+		t.Fatal(err)
+	}
+}
 
-	type subTest struct {
-		Migrations     Migrations
-		WantErr        string
-		WantMigrations []int
-		WantQuery      string
+func TestExpandVars(t *testing.T) {
+	vars := map[string]string{"SCHEMA": "tenant", "SPACE": "fast"}
+	tests := []struct {
+		SQL     string
+		Want    string
+		WantErr string
+	}{
+		{"SELECT 1", "SELECT 1", ""},
+		{"CREATE TABLE ${SCHEMA}.foo() TABLESPACE ${SPACE}", "CREATE TABLE tenant.foo() TABLESPACE fast", ""},
+		{"SELECT '$${SCHEMA}', $$ ${SCHEMA} $$, $1", "SELECT '${SCHEMA}', $$ tenant $$, $1", ""},
+		{"SELECT '${NOPE}'", "", "unknown variable: NOPE"},
+	}
+	for _, test := range tests {
+		got, err := expandVars(test.SQL, vars)
+		if err := checkErr(err, test.WantErr); err != nil {
+			t.Errorf("%q: %s", test.SQL, err)
+		} else if test.WantErr == "" && got != test.Want {
+			t.Errorf("%q: got=%q want=%q", test.SQL, got, test.Want)
+		}
 	}
+}
 
-	var (
-		tests = []struct {
-			Name     string
-			SubTests []subTest
-		}{
-			{
+func TestRewriteSQL(t *testing.T) {
+	c := Config{
+		Vars: map[string]string{"ROLE": "ddl_admin"},
+		RewriteSQL: func(m Migration) (string, error) {
+			if m.ID == 2 {
+				return "", errors.New("not allowed")
+			}
+			return "SET LOCAL role = '${ROLE}';\n" + m.SQL, nil
+		},
+	}
+	if got, err := c.prepareSQL(Migration{ID: 1, SQL: "SELECT '${ROLE}'"}); err != nil {
+		t.Fatal(err)
+	} else if want := "SET LOCAL role = '${ROLE}';\nSELECT 'ddl_admin'"; got != want {
+		t.Fatalf("got=%q want=%q", got, want)
+	}
+	_, err := c.prepareSQL(Migration{ID: 2, SQL: "SELECT 2"})
+	if err := checkErr(err, "rewrite sql: not allowed"); err != nil {
+		t.Fatal(err)
+	}
+	m := Migration{ID: 1, SQL: "SELECT 1", DownSQL: "DROP ROLE ${ROLE}"}
+	if got, err := c.prepareDownSQL(m); err != nil {
+		t.Fatal(err)
+	} else if want := "SET LOCAL role = '${ROLE}';\nDROP ROLE ddl_admin"; got != want {
+		t.Fatalf("got=%q want=%q", got, want)
+	}
+}
+
+func TestRenderTemplates(t *testing.T) {
+	c := Config{Schema: "meta", Table: "migrations", RenderTemplates: true, Vars: map[string]string{"ROLE": "app"}}
+	m := Migration{ID: 1, Description: "1_foo.sql", SQL: "GRANT SELECT ON {{.Schema}}.{{.Table}} TO {{.Vars.ROLE}}; SELECT '${ROLE}'"}
+	if got, err := c.prepareSQL(m); err != nil {
+		t.Fatal(err)
+	} else if want := "GRANT SELECT ON meta.migrations TO app; SELECT 'app'"; got != want {
+		t.Fatalf("got=%q want=%q", got, want)
+	}
+	m.DownSQL = "REVOKE SELECT ON {{.Schema}}.{{.Table}} FROM ${ROLE}"
+	if got, err := c.prepareDownSQL(m); err != nil {
+		t.Fatal(err)
+	} else if want := "REVOKE SELECT ON meta.migrations FROM app"; got != want {
+		t.Fatalf("got=%q want=%q", got, want)
+	}
+	m.SQL = "SELECT {{.Schema"
+	if _, err := c.prepareSQL(m); err == nil || !strings.HasPrefix(err.Error(), "parse template: ") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m.SQL = "SELECT '{{.Vars.MISSING}}'"
+	if _, err := c.prepareSQL(m); err == nil || !strings.HasPrefix(err.Error(), "render template: ") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestVerifyStored(t *testing.T) {
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2"},
+	}
+	stored := []storedMigration{{Migration: Migration{ID: 1, Description: "1_foo.sql"}, SHA256: sha256Hex("SELECT 1")}}
+	if got, err := verifyStored(stored, ms, false); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, ms[1:]) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, ms[1:])
+	}
+
+	var modifiedErr *ModifiedMigrationError
+	stored[0].SHA256 = sha256Hex("SELECT 'modified'")
+	_, err := verifyStored(stored, ms, false)
+	if !errors.Is(err, ErrModifiedMigration) || errors.Is(err, ErrUnknownMigration) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if !errors.As(err, &modifiedErr) || modifiedErr.ID != 1 {
+		t.Fatalf("unexpected error: %#v", err)
+	} else if err := checkErr(err, "modified migration 1 detected (1 applied)"); err != nil {
+		t.Fatal(err)
+	} else if modifiedErr.Diff != "" {
+		t.Fatalf("unexpected diff for hashed migration: %q", modifiedErr.Diff)
+	}
+
+	stored[0].SHA256 = ""
+	stored[0].SQL = "-- foo\nSELECT 'modified'"
+	_, err = verifyStored(stored, Migrations{{ID: 1, Description: "1_foo.sql", SQL: "-- foo\nSELECT 1"}}, false)
+	if err := checkErr(err, `modified migration 1 detected (1 applied): line 2 changed from "SELECT 'modified'" to "SELECT 1"`); err != nil {
+		t.Fatal(err)
+	}
+	stored[0].SQL = "SELECT 1"
+	_, err = verifyStored(stored, Migrations{{ID: 1, Description: "1_bar.sql", SQL: "SELECT 1"}}, true)
+	var descErr *DescriptionChangedError
+	if !errors.Is(err, ErrDescriptionChanged) || !errors.As(err, &descErr) || descErr.ID != 1 {
+		t.Fatalf("unexpected error: %#v", err)
+	} else if err := checkErr(err, `description changed for migration 1: got "1_bar.sql" want "1_foo.sql"`); err != nil {
+		t.Fatal(err)
+	}
+	stored[0].SQL = "-- foo\nSELECT 'modified'"
+	renamed := Migrations{{ID: 1, Description: "1_bar.sql", SQL: "-- foo\nSELECT 'modified'"}}
+	if _, err := verifyStored(stored, renamed, false); err != nil {
+		t.Fatal(err)
+	} else if _, err := verifyStored(stored, renamed, true); !errors.Is(err, ErrDescriptionChanged) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	renamed[0].SQL = "SELECT 1"
+	if _, err := verifyStored(stored, renamed, true); !errors.Is(err, ErrModifiedMigration) || errors.Is(err, ErrDescriptionChanged) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	allowed := Migrations{{ID: 1, Description: "1_foo.sql", SQL: "SELECT 'modified'", AllowModified: true}}
+	if _, err := verifyStored(stored, allowed, false); err != nil {
+		t.Fatal(err)
+	}
+	allowed[0].Description = "1_bar.sql"
+	if _, err := verifyStored(stored, allowed, true); !errors.Is(err, ErrModifiedMigration) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	gapped := []storedMigration{
+		{Migration: Migration{ID: 1, Description: "1_foo.sql"}, SHA256: sha256Hex("SELECT 1")},
+		{Migration: Migration{ID: 3, Description: "3_baz.sql"}, SHA256: sha256Hex("SELECT 3")},
+	}
+	three := append(ms[:2:2], Migration{ID: 3, Description: "3_baz.sql", SQL: "SELECT 3"})
+	_, err = verifyStored(gapped, three, false)
+	var orderErr *OutOfOrderError
+	if !errors.Is(err, ErrOutOfOrder) || errors.Is(err, ErrModifiedMigration) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if !errors.As(err, &orderErr) || orderErr.ID != 3 || !reflect.DeepEqual(orderErr.Skipped, []int64{2}) {
+		t.Fatalf("unexpected error: %#v", err)
+	} else if err := checkErr(err, "migration 3 was applied out of order, apply skipped migrations 2 with ApplyOne"); err != nil {
+		t.Fatal(err)
+	}
+
+	tagged := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1", Tags: []string{"data"}},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2", Tags: []string{"schema"}},
+		{ID: 3, Description: "3_baz.sql", SQL: "SELECT 3"},
+	}
+	skipped := []storedMigration{{Migration: Migration{ID: 2, Description: "2_bar.sql"}, SHA256: sha256Hex("SELECT 2")}}
+	if got, err := verifyStored(skipped, tagged, false); err != nil {
+		t.Fatal(err)
+	} else if want := (Migrations{tagged[0], tagged[2]}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, want)
+	}
+	tagged[0].Tags = nil
+	if _, err := verifyStored(skipped, tagged, false); !errors.Is(err, ErrOutOfOrder) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var unknownErr *UnknownMigrationError
+	_, err = verifyStored(stored, nil, false)
+	if !errors.Is(err, ErrUnknownMigration) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if !errors.As(err, &unknownErr) || unknownErr.ID != 1 {
+		t.Fatalf("unexpected error: %#v", err)
+	} else if err := checkErr(err, "unknown migration 1 in db"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testPositionError mimics pq.Error, which reports the position as a string.
+type testPositionError struct {
+	Message  string
+	Position string
+}
+
+func (e *testPositionError) Error() string { return e.Message }
+
+func TestExecError(t *testing.T) {
+	sql := "SELECT 1;\nSELECT * FROM does_not_exist;\n"
+	driverErr := &testPositionError{Message: "relation does not exist", Position: "25"}
+	err := fmt.Errorf("2 2_fail.sql: %w", &ExecError{SQL: sql, Position: errorPosition(driverErr), Err: driverErr})
+	want := `2 2_fail.sql: relation does not exist at line 2: "SELECT * FROM does_not_exist;\n"`
+	if !errors.Is(err, driverErr) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := checkErr(err, want); err != nil {
+		t.Fatal(err)
+	}
+
+	err = &ExecError{Statement: 3, SQL: strings.Repeat("x", 300), Err: errors.New("boom")}
+	if err := checkErr(err, `statement 3: boom: "`+strings.Repeat("x", 200)+`..."`); err != nil {
+		t.Fatal(err)
+	}
+
+	err = &ExecError{SQL: "SELECT '\xe9\xe9\xe9';\nSELECT 1/0;", Position: 15, Err: errors.New("division by zero")}
+	if err := checkErr(err, `division by zero at line 2: "SELECT 1/0;"`); err != nil {
+		t.Fatal(err)
+	}
+	err = &ExecError{SQL: "\xff\xff\xff\xff\n1", Position: 6, Err: errors.New("syntax error")}
+	if err := checkErr(err, `syntax error at line 2: "1"`); err != nil {
+		t.Fatal(err)
+	}
+	err = &ExecError{SQL: strings.Repeat("x", 199) + "é", Err: errors.New("boom")}
+	if err := checkErr(err, `boom: "`+strings.Repeat("x", 199)+`..."`); err != nil {
+		t.Fatal(err)
+	}
+
+	pgxErr := &struct {
+		testPositionError
+		Position int32
+	}{testPositionError{Message: "pgx"}, 7}
+	tests := []struct {
+		Err  error
+		Want int
+	}{
+		{errors.New("no position"), 0},
+		{&testPositionError{Position: "12"}, 12},
+		{&testPositionError{Position: ""}, 0},
+		{fmt.Errorf("wrapped: %w", &testPositionError{Position: "3"}), 3},
+		{pgxErr, 7},
+	}
+	for _, test := range tests {
+		if got := errorPosition(test.Err); got != test.Want {
+			t.Errorf("%v: got=%d want=%d", test.Err, got, test.Want)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	c := Config{Schema: "public", Table: "migrations", AdvisoryLockKey: 1, StatementLockTimeout: time.Second, AppliedBy: "o'brien", SplitStatements: true}
+	ms := Migrations{
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 1; SELECT 2 -- two"},
+		{ID: 3, Description: "3_baz.sql", SQL: "SELECT 3;"},
+	}
+	got, err := c.explain(ms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert := `INSERT INTO "public"."migrations" ("id", "description", "sql", "sha256", "duration", "created", "applied_by", "revision") VALUES `
+	want := "-- 2 pending migrations for \"public\".\"migrations\"\n" +
+		"SELECT pg_advisory_lock(1);\nBEGIN;\n" + c.InitSQL() +
+		"\n-- 2 2_bar.sql\n" +
+		"SET LOCAL lock_timeout = 1000;\n" +
+		"SELECT 1;\n" +
+		"SELECT 2 -- two\n;\n" +
+		insert + "(2, '2_bar.sql', '', '" + sha256Hex(ms[0].SQL) + "', '0', now() AT TIME ZONE 'UTC', 'o''brien', NULL);\n" +
+		"\n-- 3 3_baz.sql\n" +
+		"SET LOCAL lock_timeout = 1000;\n" +
+		"SELECT 3;\n" +
+		insert + "(3, '3_baz.sql', '', '" + sha256Hex(ms[1].SQL) + "', '0', now() AT TIME ZONE 'UTC', 'o''brien', NULL);\n" +
+		"\nCOMMIT;\n" +
+		"SELECT pg_advisory_unlock(1);\n"
+	if got != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	ms[1].NoTransaction = true
+	c = Config{Schema: "public", Table: "migrations", NotifyChannel: "pgmigrate"}
+	if got, err = c.explain(ms); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"COMMIT;\n\n-- 2 2_bar.sql\nBEGIN;\nSELECT 1; SELECT 2 -- two\n;\n",
+		"\n-- 3 3_baz.sql\nSELECT 3;\nINSERT",
+		`SELECT pg_notify('pgmigrate', '{"ids":[2,3]}');`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+
+	if got, err := c.explain(nil); err != nil {
+		t.Fatal(err)
+	} else if want := "-- 0 pending migrations for \"public\".\"migrations\"\n"; got != want {
+		t.Fatalf("got=%q want=%q", got, want)
+	}
+}
+
+func TestCompressSQL(t *testing.T) {
+	sql := strings.Repeat("INSERT INTO seeds VALUES (1);\n", 1000)
+	compressed, err := compressSQL(sql)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(compressed) >= len(sql) {
+		t.Fatalf("got=%d want<%d", len(compressed), len(sql))
+	} else if got, err := decompressSQL(compressed); err != nil {
+		t.Fatal(err)
+	} else if got != sql {
+		t.Fatalf("got=%q want=%q", got, sql)
+	}
+	if compressed, err := compressSQL(""); err != nil || compressed != nil {
+		t.Fatalf("got=%v, %v want=nil, nil", compressed, err)
+	}
+	c := Config{Schema: "public", Table: "migrations", CompressSQL: true}
+	if want := `ADD COLUMN IF NOT EXISTS "sql_gzip" bytea`; !strings.Contains(c.InitSQL(), want) {
+		t.Fatalf("missing %q in:\n%s", want, c.InitSQL())
+	}
+}
+
+func TestTableName(t *testing.T) {
+	if got, want := DefaultConfig.TableName(), `"migrations"."migrations"`; got != want {
+		t.Fatalf("got=%s want=%s", got, want)
+	}
+	c := Config{Schema: `my"schema`, Table: "Migrations"}
+	if got, want := c.TableName(), `"my""schema"."Migrations"`; got != want {
+		t.Fatalf("got=%s want=%s", got, want)
+	}
+}
+
+func TestLockKey(t *testing.T) {
+	c := Config{Schema: "migrations", Table: "migrations"}
+	h := fnv.New64a()
+	h.Write([]byte(`"migrations"."migrations"`))
+	if got, want := c.lockKey(), int64(h.Sum64()); got != want {
+		t.Fatalf("got=%d want=%d", got, want)
+	}
+	c.AdvisoryLockKey = 42
+	if got := c.lockKey(); got != 42 {
+		t.Fatalf("got=%d want=42", got)
+	}
+}
+
+func TestInitSQL(t *testing.T) {
+	c := Config{Schema: "meta", Table: "schema_migrations", IDColumn: "version", DurationColumnType: DurationMilliseconds}
+	want := `CREATE SCHEMA IF NOT EXISTS "meta";
+CREATE TABLE IF NOT EXISTS "meta"."schema_migrations" (
+  "version" bigint NOT NULL,
+  "description" text NOT NULL,
+  "sql" text NOT NULL,
+  "sha256" text NOT NULL DEFAULT '',
+  "duration" bigint NOT NULL,
+  "created" timestamp without time zone DEFAULT (now() AT TIME ZONE 'UTC') NOT NULL,
+  "applied_by" text,
+  "revision" text
+);
+ALTER TABLE "meta"."schema_migrations" ADD COLUMN IF NOT EXISTS "sha256" text NOT NULL DEFAULT '';
+ALTER TABLE "meta"."schema_migrations" ADD COLUMN IF NOT EXISTS "applied_by" text;
+ALTER TABLE "meta"."schema_migrations" ADD COLUMN IF NOT EXISTS "revision" text;
+CREATE UNIQUE INDEX IF NOT EXISTS "schema_migrations_id_key" ON "meta"."schema_migrations" ("version");
+`
+	if got := c.InitSQL(); got != want {
+		t.Fatalf("\ngot: %s\nwant: %s", got, want)
+	}
+	c.SkipCreateSchema = true
+	if got := c.InitSQL(); strings.Contains(got, "CREATE SCHEMA") {
+		t.Fatalf("unexpected CREATE SCHEMA: %s", got)
+	}
+
+	c.TableOwner = "ddl_admin"
+	c.GrantSelectTo = []string{"monitoring", "reporting"}
+	want = `ALTER TABLE "meta"."schema_migrations" OWNER TO "ddl_admin";
+GRANT SELECT ON "meta"."schema_migrations" TO "monitoring", "reporting";
+`
+	if got := c.InitSQL(); !strings.HasSuffix(got, want) {
+		t.Fatalf("\ngot: %s\nwant suffix: %s", got, want)
+	}
+}
+
+func TestSetLocalSQL(t *testing.T) {
+	tests := []struct {
+		timeout time.Duration
+		want    string
+	}{
+		{time.Microsecond, "SET LOCAL statement_timeout = 1"},
+		{time.Millisecond, "SET LOCAL statement_timeout = 1"},
+		{1500 * time.Microsecond, "SET LOCAL statement_timeout = 2"},
+		{time.Minute, "SET LOCAL statement_timeout = 60000"},
+	}
+	for _, test := range tests {
+		c := Config{StatementTimeout: test.timeout}
+		if got := c.setLocalSQL(); !reflect.DeepEqual(got, []string{test.want}) {
+			t.Fatalf("%s: got=%q want=%q", test.timeout, got, test.want)
+		}
+	}
+	c := Config{StatementTimeout: time.Second, StatementLockTimeout: time.Microsecond}
+	want := []string{"SET LOCAL statement_timeout = 1000", "SET LOCAL lock_timeout = 1"}
+	if got := c.setLocalSQL(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got=%q want=%q", got, want)
+	}
+	if got := (&Config{}).setLocalSQL(); len(got) != 0 {
+		t.Fatalf("got=%q want none", got)
+	}
+}
+
+func TestOrder(t *testing.T) {
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_backfill.sql", SQL: "SELECT 2"},
+		{ID: 3, Description: "3_baz.sql", SQL: "SELECT 3"},
+	}
+	tests := []struct {
+		Order   []int64
+		WantErr string
+	}{
+		{nil, ""},
+		{[]int64{1, 3, 2}, ""},
+		{[]int64{1, 3}, "invalid order: missing migration id 2"},
+		{[]int64{1, 3, 2, 4}, "invalid order: unknown migration id 4"},
+		{[]int64{1, 3, 3, 2}, "invalid order: duplicate migration id 3"},
+	}
+	for _, test := range tests {
+		c := Config{Order: test.Order}
+		if err := checkErr(c.validate(ms), test.WantErr); err != nil {
+			t.Errorf("%v: %s", test.Order, err)
+		}
+	}
+
+	c := Config{Order: []int64{1, 3, 2}}
+	stored := []storedMigration{
+		{Migration: Migration{ID: 1, Description: "1_foo.sql"}, SHA256: sha256Hex("SELECT 1")},
+		{Migration: Migration{ID: 3, Description: "3_baz.sql"}, SHA256: sha256Hex("SELECT 3")},
+	}
+	if got, err := c.verify(stored, ms); err != nil {
+		t.Fatal(err)
+	} else if want := []int64{2}; !reflect.DeepEqual(got.IDs(), want) {
+		t.Fatalf("got=%v want=%v", got.IDs(), want)
+	} else if got, err := c.verify(stored[:1], ms); err != nil {
+		t.Fatal(err)
+	} else if want := []int64{3, 2}; !reflect.DeepEqual(got.IDs(), want) {
+		t.Fatalf("got=%v want=%v", got.IDs(), want)
+	} else if want := []int64{1, 2, 3}; !reflect.DeepEqual(ms.IDs(), want) {
+		t.Fatalf("ms was modified: got=%v want=%v", ms.IDs(), want)
+	}
+	c.Order = nil
+	if _, err := c.verify(stored, ms); !errors.Is(err, ErrOutOfOrder) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	p := &Plan{
+		Applied: Migrations{{ID: 1, Description: "1_foo.sql"}},
+		Pending: Migrations{{ID: 2, Description: "2_bar.sql"}, {ID: 3, Description: "3_baz.sql"}},
+	}
+	want := `1 applied, 2 pending migrations
+applied 1 1_foo.sql
+pending 2 2_bar.sql
+pending 3 3_baz.sql
+`
+	if got := p.String(); got != want {
+		t.Fatalf("\ngot: %s\nwant: %s\n", got, want)
+	} else if err := p.Valid(); err != nil {
+		t.Fatal(err)
+	}
+
+	p = &Plan{err: errors.New("modified migration 1 detected")}
+	want = "invalid plan: modified migration 1 detected\n"
+	if got := p.String(); got != want {
+		t.Fatalf("\ngot: %s\nwant: %s\n", got, want)
+	} else if err := checkErr(p.Valid(), "modified migration 1 detected"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfig_Plan(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2"},
+	}
+	if _, err := c.Migrate(db, ms[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := c.Plan(db, ms); err != nil {
+		t.Fatal(err)
+	} else if err := p.Valid(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(p.Applied, ms[:1]) || !reflect.DeepEqual(p.Pending, ms[1:]) {
+		t.Fatalf("unexpected plan: %s", p)
+	}
+	ms[0].SQL = "SELECT 'modified'"
+	if p, err := c.Plan(db, ms); err != nil {
+		t.Fatal(err)
+	} else if err := checkErr(p.Valid(), "modified migration 1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrations_validAllowGaps(t *testing.T) {
+	tests := []struct {
+		Migrations Migrations
+		WantErr    string
+	}{
+		{
+			Migrations{
+				{ID: 10, Description: "10_foo.sql", SQL: "SELECT 1"},
+				{ID: 20, Description: "20_bar.sql", SQL: "SELECT 2"},
+			},
+			"",
+		},
+		{
+			Migrations{
+				{ID: 10, Description: "10_foo.sql", SQL: "SELECT 1"},
+				{ID: 10, Description: "10_bar.sql", SQL: "SELECT 2"},
+			},
+			"duplicate migration id 10: 10_foo.sql and 10_bar.sql",
+		},
+		{
+			Migrations{
+				{ID: 10, Description: "10_foo.sql", SQL: "SELECT 1"},
+				{ID: 5, Description: "5_bar.sql", SQL: "SELECT 2"},
+			},
+			"unexpected migration id: got=5 want>10",
+		},
+		{
+			Migrations{{ID: 0, Description: "0_foo.sql", SQL: "SELECT 1"}},
+			"invalid id: 0",
+		},
+	}
+	for _, test := range tests {
+		gotErr := test.Migrations.valid(true)
+		if err := checkErr(gotErr, test.WantErr); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestConfig_Migrate(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type subTest struct {
+		Migrations     Migrations
+		WantErr        string
+		WantMigrations []int
+		WantQuery      string
+	}
+
+	var (
+		tests = []struct {
+			Name     string
+			SubTests []subTest
+		}{
+			{
 				Name: "single migration that creates a schema and table",
 				SubTests: []subTest{
 					{
 						Migrations: Migrations{
 							{
-								1,
-								"1_create_schema_and_table.sql",
-								"CREATE SCHEMA foo; CREATE TABLE foo.bar();",
+								ID:          1,
+								Description: "1_create_schema_and_table.sql",
+								SQL:         "CREATE SCHEMA foo; CREATE TABLE foo.bar();",
 							},
 						},
 						WantQuery:      "SELECT EXISTS(SELECT * FROM information_schema.tables WHERE table_schema = 'foo' AND table_name = 'bar')",
@@ -144,14 +1177,14 @@ func TestConfig_Migrate(t *testing.T) {
 					{
 						Migrations: Migrations{
 							{
-								1,
-								"1_create_schema.sql",
-								"CREATE SCHEMA foo;",
+								ID:          1,
+								Description: "1_create_schema.sql",
+								SQL:         "CREATE SCHEMA foo;",
 							},
 							{
-								2,
-								"2_create_table.sql",
-								"CREATE TABLE foo.bar();",
+								ID:          2,
+								Description: "2_create_table.sql",
+								SQL:         "CREATE TABLE foo.bar();",
 							},
 						},
 						WantQuery:      "SELECT EXISTS(SELECT * FROM information_schema.tables WHERE table_schema = 'foo' AND table_name = 'bar')",
@@ -165,9 +1198,9 @@ func TestConfig_Migrate(t *testing.T) {
 					{
 						Migrations: Migrations{
 							{
-								1,
-								"1_create_schema.sql",
-								"CREATE SCHEMA foo;",
+								ID:          1,
+								Description: "1_create_schema.sql",
+								SQL:         "CREATE SCHEMA foo;",
 							},
 						},
 						WantMigrations: []int{0},
@@ -175,14 +1208,14 @@ func TestConfig_Migrate(t *testing.T) {
 					{
 						Migrations: Migrations{
 							{
-								1,
-								"1_create_schema.sql",
-								"CREATE SCHEMA foo;",
+								ID:          1,
+								Description: "1_create_schema.sql",
+								SQL:         "CREATE SCHEMA foo;",
 							},
 							{
-								2,
-								"2_create_table.sql",
-								"CREATE TABLE foo.bar();",
+								ID:          2,
+								Description: "2_create_table.sql",
+								SQL:         "CREATE TABLE foo.bar();",
 							},
 						},
 						WantQuery:      "SELECT EXISTS(SELECT * FROM information_schema.tables WHERE table_schema = 'foo' AND table_name = 'bar')",
@@ -196,9 +1229,9 @@ func TestConfig_Migrate(t *testing.T) {
 					{
 						Migrations: Migrations{
 							{
-								1,
-								"1_create_schema.sql",
-								"CREATE SCHEMA foo;",
+								ID:          1,
+								Description: "1_create_schema.sql",
+								SQL:         "CREATE SCHEMA foo;",
 							},
 						},
 						WantMigrations: []int{0},
@@ -215,9 +1248,9 @@ func TestConfig_Migrate(t *testing.T) {
 					{
 						Migrations: Migrations{
 							{
-								1,
-								"1_create_schema.sql",
-								"CREATE SCHEMA foo;",
+								ID:          1,
+								Description: "1_create_schema.sql",
+								SQL:         "CREATE SCHEMA foo;",
 							},
 						},
 						WantMigrations: []int{0},
@@ -225,9 +1258,9 @@ func TestConfig_Migrate(t *testing.T) {
 					{
 						Migrations: Migrations{
 							{
-								1,
-								"1_create_schema.sql",
-								"CREATE SCHEMA bar;",
+								ID:          1,
+								Description: "1_create_schema.sql",
+								SQL:         "CREATE SCHEMA bar;",
 							},
 						},
 						WantErr: "modified migration",
@@ -266,7 +1299,7 @@ func TestConfig_Migrate(t *testing.T) {
 						t.Fatalf("missing return miration: %d", i)
 					} else if j >= len(subTest.Migrations) {
 						t.Fatalf("invalid return migration reference: %d", j)
-					} else if ms[i] != subTest.Migrations[j] {
+					} else if !reflect.DeepEqual(ms[i], subTest.Migrations[j]) {
 						t.Fatalf("unexpected migration")
 					}
 				}
@@ -275,6 +1308,2108 @@ func TestConfig_Migrate(t *testing.T) {
 	}
 }
 
+func TestConfig_Migrate_func(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_create_table.sql", SQL: "CREATE TABLE public.foo (bar text);"},
+		{ID: 2, Description: "2_insert.go", Func: func(ctx context.Context, q Querier) error {
+			tx, ok := SQLTx(q)
+			if !ok {
+				return errors.New("not a *sql.Tx")
+			}
+			_, err := tx.ExecContext(ctx, "INSERT INTO public.foo VALUES ($1)", "from go")
+			return err
+		}},
+	}
+	if _, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	}
+	var bar string
+	if err := db.QueryRow("SELECT bar FROM public.foo").Scan(&bar); err != nil {
+		t.Fatal(err)
+	} else if bar != "from go" {
+		t.Fatalf("got=%q want=%q", bar, "from go")
+	}
+	applied, err := c.Applied(db)
+	if err != nil {
+		t.Fatal(err)
+	} else if !strings.HasPrefix(applied[1].SQL, "-- func github.com/felixge/pgmigrate.TestConfig_Migrate_func") {
+		t.Fatalf("unexpected placeholder: %q", applied[1].SQL)
+	}
+	if pending, err := c.Pending(db, ms); err != nil {
+		t.Fatal(err)
+	} else if len(pending) != 0 {
+		t.Fatalf("got=%d want=0", len(pending))
+	}
+}
+
+func TestConfig_Migrate_sha256(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2"},
+	}
+	if _, err := c.Migrate(db, ms[:1]); err != nil {
+		t.Fatal(err)
+	}
+	var gotSQL, gotHash string
+	if err := db.QueryRow("SELECT sql, sha256 FROM "+c.table()).Scan(&gotSQL, &gotHash); err != nil {
+		t.Fatal(err)
+	} else if gotSQL != "" {
+		t.Fatalf("got=%q want=%q", gotSQL, "")
+	} else if want := sha256Hex(ms[0].SQL); gotHash != want {
+		t.Fatalf("got=%q want=%q", gotHash, want)
+	}
+
+	// rows created by older versions only have the sql column populated
+	legacySQL := "INSERT INTO " + c.table() + " (id, description, sql, duration) VALUES (2, '2_bar.sql', 'SELECT 2', '0s')"
+	if _, err := db.Exec(legacySQL); err != nil {
+		t.Fatal(err)
+	} else if got, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 0 {
+		t.Fatalf("got=%d want=0", len(got))
+	}
+	ms[1].SQL = "SELECT 3"
+	_, err = c.Migrate(db, ms)
+	if err := checkErr(err, "modified migration 2"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfig_Migrate_privileges(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations", GrantSelectTo: []string{"pgmigrate_monitoring"}}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	} else if _, err := db.Exec("DROP ROLE IF EXISTS pgmigrate_monitoring"); err != nil {
+		t.Fatal(err)
+	} else if _, err := db.Exec("CREATE ROLE pgmigrate_monitoring"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"}}
+	for i := 0; i < 2; i++ {
+		var ok bool
+		if _, err := c.Migrate(db, ms); err != nil {
+			t.Fatal(err)
+		} else if err := db.QueryRow("SELECT has_table_privilege('pgmigrate_monitoring', 'public.migrations', 'SELECT')").Scan(&ok); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatal("expected SELECT to be granted")
+		}
+	}
+}
+
+func TestConfig_Migrate_createSchema(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "foo", Table: "migrations", SkipCreateSchema: true}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public, foo CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"}}
+	_, err = c.Migrate(db, ms)
+	if err := checkErr(err, `schema "foo" does not exist`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("CREATE SCHEMA foo"); err != nil {
+		t.Fatal(err)
+	} else if _, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfig_Migrate_txPerMigration(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations", TxMode: TxPerMigration}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public, foo CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_create_schema.sql", SQL: "CREATE SCHEMA foo;"},
+		{ID: 2, Description: "2_create_table.sql", SQL: "CREATE TABLE foo.bar();"},
+		{ID: 3, Description: "3_fail.sql", SQL: "SELECT * FROM does_not_exist;"},
+	}
+	_, err = c.Migrate(db, ms)
+	if err := checkErr(err, "2 of 3 migrations applied"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.Pending(db, ms)
+	if err != nil {
+		t.Fatal(err)
+	} else if want := ms[2:]; !reflect.DeepEqual(got, want) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, want)
+	}
+}
+
+func TestConfig_Migrate_savepoints(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations", UseSavepoints: true}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_create_table.sql", SQL: "CREATE TABLE public.foo();"},
+		{ID: 2, Description: "2_fail.sql", SQL: "SELECT * FROM does_not_exist"},
+	}
+	_, err = c.Migrate(db, ms)
+	if err := checkErr(err, `relation "does_not_exist" does not exist`); err != nil {
+		t.Fatal(err)
+	}
+	var exists bool
+	if err := db.QueryRow("SELECT to_regclass('public.foo') IS NOT NULL").Scan(&exists); err != nil {
+		t.Fatal(err)
+	} else if exists {
+		t.Fatal("expected all migrations to be rolled back")
+	}
+	ms[1].SQL = "SELECT 2"
+	if got, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, ms) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, ms)
+	}
+}
+
+func TestConfig_Migrate_noTransaction(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public, foo CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_create_table.sql", SQL: "CREATE SCHEMA foo; CREATE TABLE foo.bar(id int);"},
+		{ID: 2, Description: "2_create_index.sql", SQL: "CREATE INDEX CONCURRENTLY bar_id_idx ON foo.bar (id);", NoTransaction: true},
+	}
+	if got, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, ms) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, ms)
+	}
+	if got, err := c.Pending(db, ms); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 0 {
+		t.Fatalf("got=%d want=0", len(got))
+	}
+}
+
+func TestConfig_Migrate_lock(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations", AdvisoryLockTimeout: 100 * time.Millisecond}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_lock($1)", c.lockKey()); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"}}
+	_, err = c.Migrate(db, ms)
+	if err := checkErr(err, "could not acquire migration lock"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", c.lockKey()); err != nil {
+		t.Fatal(err)
+	} else if _, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfig_Migrate_lockCancel(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations", AdvisoryLockTimeout: time.Minute}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_lock($1)", c.lockKey()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	ms := Migrations{{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"}}
+	start := time.Now()
+	_, err = c.MigrateContext(ctx, db, ms)
+	if err := checkErr(err, "migration lock wait cancelled"); err != nil {
+		t.Fatal(err)
+	} else if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled: %v", err)
+	} else if time.Since(start) > 10*time.Second {
+		t.Fatal("expected cancellation to interrupt the lock wait")
+	}
+}
+
+func TestConfig_Migrate_deadline(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_create_table.sql", SQL: "CREATE TABLE public.foo();"},
+		{ID: 2, Description: "2_sleep.sql", SQL: "SELECT pg_sleep(10)"},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = c.MigrateContext(ctx, db, ms)
+	if err := checkErr(err, "migration deadline exceeded"); err != nil {
+		t.Fatal(err)
+	} else if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded: %v", err)
+	}
+	var exists bool
+	if err := db.QueryRow("SELECT to_regclass('public.foo') IS NOT NULL").Scan(&exists); err != nil {
+		t.Fatal(err)
+	} else if exists {
+		t.Fatal("expected migrations to be rolled back")
+	}
+	c.AdvisoryLockTimeout = 100 * time.Millisecond
+	if _, err := c.Migrate(db, ms[:1]); err != nil {
+		t.Fatalf("expected advisory lock to be released: %v", err)
+	}
+}
+
+func TestConfig_Migrate_lockTimeout(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations", StatementLockTimeout: 50 * time.Millisecond}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{{ID: 1, Description: "1_create_table.sql", SQL: "CREATE TABLE public.foo();"}}
+	if _, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("LOCK TABLE public.foo IN ACCESS EXCLUSIVE MODE"); err != nil {
+		t.Fatal(err)
+	}
+	ms = append(ms, Migration{ID: 2, Description: "2_alter_table.sql", SQL: "ALTER TABLE public.foo ADD COLUMN bar int;"})
+	_, err = c.Migrate(db, ms)
+	if err := checkErr(err, "canceling statement due to lock timeout"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	} else if _, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfig_Migrate_statementTimeout(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations", StatementTimeout: 50 * time.Millisecond}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{{ID: 1, Description: "1_sleep.sql", SQL: "SELECT pg_sleep(1)"}}
+	_, err = c.Migrate(db, ms)
+	if err := checkErr(err, "canceling statement due to statement timeout"); err != nil {
+		t.Fatal(err)
+	}
+	c.StatementTimeout = 0
+	if _, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfig_Migrate_searchPath(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations", SearchPath: []string{"foo", "public"}}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public, foo CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_create_schema.sql", SQL: "CREATE SCHEMA foo;"},
+		{ID: 2, Description: "2_create_table.sql", SQL: "CREATE TABLE bar();"},
+	}
+	if _, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	}
+	var exists bool
+	if err := db.QueryRow("SELECT to_regclass('foo.bar') IS NOT NULL").Scan(&exists); err != nil {
+		t.Fatal(err)
+	} else if !exists {
+		t.Fatal("expected foo.bar to be created")
+	}
+	var searchPath string
+	if err := db.QueryRow("SHOW search_path").Scan(&searchPath); err != nil {
+		t.Fatal(err)
+	} else if strings.Contains(searchPath, "foo") {
+		t.Fatalf("search_path leaked into connection: %s", searchPath)
+	}
+}
+
+func TestConfig_Migrate_hooks(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls []string
+	c := Config{
+		Schema: "public",
+		Table:  "migrations",
+		BeforeMigration: func(m Migration) {
+			calls = append(calls, fmt.Sprintf("before %d", m.ID))
+		},
+		AfterMigration: func(m Migration, d time.Duration, err error) {
+			calls = append(calls, fmt.Sprintf("after %d %t", m.ID, err == nil))
+		},
+		Progress: func(done, total int, current Migration) {
+			calls = append(calls, fmt.Sprintf("progress %d/%d %s", done, total, current.Description))
+		},
+	}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_fail.sql", SQL: "SELECT * FROM does_not_exist"},
+	}
+	if _, err := c.Migrate(db, ms); err == nil {
+		t.Fatal("expected error")
+	}
+	want := []string{"progress 0/2 1_foo.sql", "before 1", "after 1 true", "progress 1/2 2_fail.sql", "before 2", "after 2 false"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Fatalf("got=%v want=%v", calls, want)
+	}
+}
+
+func TestConfig_Migrate_columns(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{
+		Schema:            "public",
+		Table:             "migrations",
+		IDColumn:          "migration_id",
+		DescriptionColumn: "migration_description",
+		SQLColumn:         "migration_sql",
+		DurationColumn:    "migration_duration",
+		CreatedColumn:     "migration_created",
+	}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2"},
+	}
+	if _, err := c.Migrate(db, ms[:1]); err != nil {
+		t.Fatal(err)
+	} else if got, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, ms[1:]) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, ms[1:])
+	} else if applied, err := c.Applied(db); err != nil {
+		t.Fatal(err)
+	} else if len(applied) != 2 {
+		t.Fatalf("got=%d want=2", len(applied))
+	}
+	var count int
+	if err := db.QueryRow("SELECT count(migration_sql) FROM public.migrations").Scan(&count); err != nil {
+		t.Fatal(err)
+	} else if count != 2 {
+		t.Fatalf("got=%d want=2", count)
+	}
+}
+
+func TestConfig_Migrate_metaDB(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaDB, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer metaDB.Close()
+	c := Config{Schema: "meta", Table: "migrations", MetaDB: metaDB}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public, meta, foo CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "CREATE SCHEMA foo; CREATE TABLE foo.bar();"},
+		{ID: 2, Description: "2_bar.sql", SQL: "CREATE INDEX CONCURRENTLY bar_idx ON foo.bar ((1))", NoTransaction: true},
+		{ID: 3, Description: "3_baz.sql", SQL: "SELECT * FROM does_not_exist"},
+	}
+	if got, err := c.Migrate(db, ms[:2]); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 2 {
+		t.Fatalf("got=%d want=2", len(got))
+	} else if applied, err := c.Applied(db); err != nil {
+		t.Fatal(err)
+	} else if len(applied) != 2 {
+		t.Fatalf("got=%d want=2", len(applied))
+	}
+	if _, err := c.Migrate(db, ms); err == nil {
+		t.Fatal("expected error")
+	} else if version, err := c.Version(db); err != nil {
+		t.Fatal(err)
+	} else if version != 2 {
+		t.Fatalf("got=%d want=2", version)
+	}
+	if _, err := c.Rollback(db, ms, 0); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestConfig_MigrateTagged(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1", Tags: []string{"schema"}},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2", Tags: []string{"backfill"}},
+		{ID: 3, Description: "3_baz.sql", SQL: "SELECT 3", Tags: []string{"schema", "backfill"}},
+		{ID: 4, Description: "4_qux.sql", SQL: "SELECT 4"},
+		{ID: 5, Description: "5_quux.sql", SQL: "SELECT 5", Tags: []string{"schema"}},
+	}
+	if got, err := c.MigrateTagged(db, ms, "schema"); err != nil {
+		t.Fatal(err)
+	} else if want := []int64{1, 3}; !reflect.DeepEqual(got.IDs(), want) {
+		t.Fatalf("got=%v want=%v", got.IDs(), want)
+	}
+	if pending, err := c.Pending(db, ms); err != nil {
+		t.Fatal(err)
+	} else if want := []int64{2, 4, 5}; !reflect.DeepEqual(pending.IDs(), want) {
+		t.Fatalf("got=%v want=%v", pending.IDs(), want)
+	}
+	if got, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	} else if want := []int64{2, 4, 5}; !reflect.DeepEqual(got.IDs(), want) {
+		t.Fatalf("got=%v want=%v", got.IDs(), want)
+	}
+	if applied, err := c.Applied(db); err != nil {
+		t.Fatal(err)
+	} else if len(applied) != len(ms) {
+		t.Fatalf("got=%d want=%d", len(applied), len(ms))
+	}
+}
+
+func TestConfig_MigrateTx(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "CREATE TABLE public.foo (id int)"},
+		{ID: 2, Description: "2_bar.sql", SQL: "INSERT INTO public.foo VALUES (1)"},
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.MigrateTx(tx, ms); err != nil {
+		t.Fatal(err)
+	} else if len(got) != len(ms) {
+		t.Fatalf("got=%d want=%d", len(got), len(ms))
+	} else if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	} else if applied, err := c.Applied(db); err != nil {
+		t.Fatal(err)
+	} else if len(applied) != 0 {
+		t.Fatalf("got=%d want=0", len(applied))
+	}
+
+	if tx, err = db.Begin(); err != nil {
+		t.Fatal(err)
+	} else if _, err := c.MigrateTx(tx, ms); err != nil {
+		t.Fatal(err)
+	} else if _, err := tx.Exec("INSERT INTO public.foo VALUES (2)"); err != nil {
+		t.Fatal(err)
+	} else if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM public.foo").Scan(&n); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatalf("got=%d want=2", n)
+	} else if pending, err := c.Pending(db, ms); err != nil {
+		t.Fatal(err)
+	} else if len(pending) != 0 {
+		t.Fatalf("got=%d want=0", len(pending))
+	}
+}
+
+func TestConfig_Migrate_maxApply(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations", MaxApply: 2}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2"},
+		{ID: 3, Description: "3_baz.sql", SQL: "SELECT 3"},
+	}
+	for _, want := range [][]int64{{1, 2}, {3}, {}} {
+		if got, err := c.Migrate(db, ms); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(got.IDs(), want) {
+			t.Fatalf("got=%v want=%v", got.IDs(), want)
+		}
+	}
+}
+
+func TestConfig_Migrate_breaking(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2", Breaking: true},
+	}
+	if got, err := c.PendingBreaking(db, ms); err != nil {
+		t.Fatal(err)
+	} else if want := []int64{2}; !reflect.DeepEqual(got.IDs(), want) {
+		t.Fatalf("got=%v want=%v", got.IDs(), want)
+	}
+	_, err = c.Migrate(db, ms)
+	if err := checkErr(err, "2 2_bar.sql: breaking migration is not allowed, see Config.AllowBreaking"); err != nil {
+		t.Fatal(err)
+	} else if got, err := c.Migrate(db, ms[:1]); err != nil {
+		t.Fatal(err)
+	} else if want := []int64{1}; !reflect.DeepEqual(got.IDs(), want) {
+		t.Fatalf("got=%v want=%v", got.IDs(), want)
+	}
+	c.AllowBreaking = true
+	if got, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	} else if want := []int64{2}; !reflect.DeepEqual(got.IDs(), want) {
+		t.Fatalf("got=%v want=%v", got.IDs(), want)
+	} else if got, err := c.PendingBreaking(db, ms); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 0 {
+		t.Fatalf("got=%v want=[]", got.IDs())
+	}
+}
+
+func TestConfig_MigrateReport(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2"},
+		{ID: 3, Description: "3_baz.sql", SQL: "SELECT 3"},
+		{ID: 4, Description: "4_qux.sql", SQL: "SELECT 4"},
+	}
+	if _, err := c.Migrate(db, ms[:1]); err != nil {
+		t.Fatal(err)
+	}
+	c.MaxApply = 2
+	report, err := c.MigrateReport(db, ms)
+	if err != nil {
+		t.Fatal(err)
+	} else if got, want := report.Applied.IDs(), []int64{2, 3}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got=%v want=%v", got, want)
+	} else if want := []int64{1}; !reflect.DeepEqual(report.AlreadyApplied, want) {
+		t.Fatalf("got=%v want=%v", report.AlreadyApplied, want)
+	} else if want := []int64{4}; !reflect.DeepEqual(report.Pending, want) {
+		t.Fatalf("got=%v want=%v", report.Pending, want)
+	} else if len(report.Durations) != 2 || report.Duration <= 0 {
+		t.Fatalf("unexpected timings: %v %s", report.Durations, report.Duration)
+	}
+}
+
+func TestConfig_Check(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "CREATE TABLE public.foo (id int)"},
+		{ID: 2, Description: "2_bar.sql", SQL: "INSERT INTO public.foo VALUES (1)"},
+	}
+	if err := c.Check(db, ms); err != nil {
+		t.Fatal(err)
+	} else if pending, err := c.Pending(db, ms); err != nil {
+		t.Fatal(err)
+	} else if len(pending) != len(ms) {
+		t.Fatalf("got=%d want=%d", len(pending), len(ms))
+	}
+	var exists bool
+	if err := db.QueryRow("SELECT to_regclass('public.foo') IS NOT NULL").Scan(&exists); err != nil {
+		t.Fatal(err)
+	} else if exists {
+		t.Fatal("check was not rolled back")
+	}
+
+	ms = append(ms, Migration{ID: 3, Description: "3_baz.sql", SQL: "SELEC 3"})
+	if err := c.Check(db, ms); err == nil || !strings.HasPrefix(err.Error(), "3 3_baz.sql: ") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ms[2] = Migration{ID: 3, Description: "3_baz.sql", SQL: "SELECT 3", NoTransaction: true}
+	if err := checkErr(c.Check(db, ms), "3 3_baz.sql: cannot check NoTransaction migration"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfig_MigrateAllSchemas(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	schemas := []string{"tenant_1", "tenant_2", "tenant_3"}
+	for _, schema := range schemas {
+		if _, err := db.Exec("DROP SCHEMA IF EXISTS " + schema + " CASCADE"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec("CREATE SCHEMA tenant_2; CREATE TABLE tenant_2.foo (id int)"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{{ID: 1, Description: "1_foo.sql", SQL: "CREATE TABLE foo (id int)"}}
+	c := Config{Table: "migrations"}
+	results, err := c.MigrateAllSchemas(db, ms, schemas)
+	if err == nil || !strings.HasPrefix(err.Error(), "schema tenant_2: ") {
+		t.Fatalf("unexpected error: %v", err)
+	} else if len(results) != 2 || results[0].Err != nil || len(results[0].Migrations) != 1 || results[1].Err == nil {
+		t.Fatalf("unexpected results: %#v", results)
+	}
+
+	if _, err := db.Exec("DROP TABLE tenant_2.foo"); err != nil {
+		t.Fatal(err)
+	}
+	c.ContinueOnSchemaError = true
+	results, err = c.MigrateAllSchemas(db, ms, schemas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var applied []int
+	for _, r := range results {
+		applied = append(applied, len(r.Migrations))
+	}
+	if want := []int{0, 1, 1}; !reflect.DeepEqual(applied, want) {
+		t.Fatalf("got=%v want=%v", applied, want)
+	}
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM information_schema.tables WHERE table_name = 'foo' AND table_schema LIKE 'tenant_%'").Scan(&n); err != nil {
+		t.Fatal(err)
+	} else if n != len(schemas) {
+		t.Fatalf("got=%d want=%d", n, len(schemas))
+	}
+}
+
+func TestConfig_ExplainPlan(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "CREATE TABLE public.foo (s text)"},
+		{ID: 2, Description: "2_bar.sql", SQL: "INSERT INTO public.foo VALUES ('it''s')"},
+	}
+	limited := c
+	limited.MaxApply = 1
+	if script, err := limited.ExplainPlan(db, ms); err != nil {
+		t.Fatal(err)
+	} else if !strings.HasPrefix(script, "-- 1 pending migrations") {
+		t.Fatalf("unexpected script: %s", script)
+	}
+	breaking := append(Migrations{}, ms...)
+	breaking[1].Breaking = true
+	_, err = c.ExplainPlan(db, breaking)
+	if err := checkErr(err, "2 2_bar.sql: breaking migration is not allowed"); err != nil {
+		t.Fatal(err)
+	}
+	script, err := c.ExplainPlan(db, ms)
+	if err != nil {
+		t.Fatal(err)
+	} else if exists, err := c.tableExists(context.Background(), SQLDB(db)); err != nil {
+		t.Fatal(err)
+	} else if exists {
+		t.Fatal("expected migrations table to not be created")
+	}
+	if _, err := db.Exec(script); err != nil {
+		t.Fatal(err)
+	} else if ok, err := c.IsUpToDate(db, ms); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("expected up to date")
+	} else if script, err = c.ExplainPlan(db, ms); err != nil {
+		t.Fatal(err)
+	} else if !strings.HasPrefix(script, "-- 0 pending migrations") {
+		t.Fatalf("unexpected script: %s", script)
+	}
+}
+
+func TestConfig_Migrate_minVersion(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "CREATE TABLE public.foo()", MinVersion: 9},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2", MinVersion: 999},
+	}
+	_, err = c.Migrate(db, ms)
+	if err := checkErr(err, "2 2_bar.sql: requires postgres 999, but the server is postgres"); err != nil {
+		t.Fatal(err)
+	} else if exists, err := c.tableExists(context.Background(), SQLDB(db)); err != nil {
+		t.Fatal(err)
+	} else if !exists {
+		t.Fatal("expected migrations table to exist")
+	} else if applied, err := c.Applied(db); err != nil {
+		t.Fatal(err)
+	} else if len(applied) != 0 {
+		t.Fatalf("got=%d want=0", len(applied))
+	}
+	if got, err := c.Migrate(db, ms[:1]); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 1 {
+		t.Fatalf("got=%d want=1", len(got))
+	}
+}
+
+func TestConfig_Migrate_precheck(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "CREATE TABLE public.foo (id int)"},
+		{ID: 2, Description: "2_bar.sql", SQL: "INSERT INTO public.foo VALUES (2)", PrecheckSQL: "SELECT count(*) = 0 FROM public.foo"},
+		{ID: 3, Description: "3_baz.sql", SQL: "INSERT INTO public.foo VALUES (3)", PrecheckSQL: "SELECT count(*) = 0 FROM public.foo"},
+	}
+	if got, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	} else if len(got) != len(ms) {
+		t.Fatalf("got=%d want=%d", len(got), len(ms))
+	}
+	var ids []int64
+	rows, err := db.Query("SELECT id FROM public.foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if want := []int64{2}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("got=%v want=%v", ids, want)
+	}
+
+	ms = append(ms, Migration{ID: 4, Description: "4_qux.sql", SQL: "SELECT 4", PrecheckSQL: "SELECT 1"})
+	if _, err := c.Migrate(db, ms); err == nil || !strings.HasPrefix(err.Error(), "4 4_qux.sql: precheck: ") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestConfig_Migrate_order(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations", Order: []int64{1, 3, 2}}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "CREATE TABLE public.foo (id int)"},
+		{ID: 2, Description: "2_bar.sql", SQL: "ALTER TABLE public.foo ADD COLUMN bar int"},
+		{ID: 3, Description: "3_baz.sql", SQL: "INSERT INTO public.foo (id) VALUES (1)"},
+	}
+	if got, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	} else if want := []int64{1, 3, 2}; !reflect.DeepEqual(got.IDs(), want) {
+		t.Fatalf("got=%v want=%v", got.IDs(), want)
+	} else if ok, err := c.IsUpToDate(db, ms); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("expected up to date")
+	}
+}
+
+func TestConfig_Migrate_tracer(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tracer testTracer
+	c := Config{Schema: "public", Table: "migrations", Tracer: &tracer}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT * FROM does_not_exist"},
+	}
+	if _, err := c.Migrate(db, ms); err == nil {
+		t.Fatal("expected error")
+	}
+	want := []string{
+		"start pgmigrate.init",
+		"finish pgmigrate.init: <nil>",
+		"start pgmigrate.verify",
+		"finish pgmigrate.verify: <nil>",
+		"start pgmigrate.migration 1 1_foo.sql",
+		"finish pgmigrate.migration 1 1_foo.sql: <nil>",
+		"start pgmigrate.migration 2 2_bar.sql",
+	}
+	if len(tracer) != len(want)+1 || !reflect.DeepEqual([]string(tracer[:len(want)]), want) {
+		t.Fatalf("\ngot: %q\nwant: %q", tracer, want)
+	} else if last := tracer[len(want)]; !strings.Contains(last, "does_not_exist") {
+		t.Fatalf("unexpected span: %q", last)
+	}
+}
+
+func TestConfig_Migrate_isolationLevel(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, txMode := range []TxMode{TxAll, TxPerMigration} {
+		c := Config{Schema: "public", Table: "migrations", TxMode: txMode, IsolationLevel: sql.LevelSerializable}
+		if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+			t.Fatal(err)
+		}
+		ms := Migrations{{ID: 1, Description: "1_foo.sql", SQL: `DO $$
+BEGIN
+	IF current_setting('transaction_isolation') <> 'serializable' THEN
+		RAISE EXCEPTION 'unexpected isolation level %', current_setting('transaction_isolation');
+	END IF;
+END $$`}}
+		if _, err := c.Migrate(db, ms); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := Config{Schema: "public", Table: "migrations", IsolationLevel: sql.LevelLinearizable}
+	if _, err := c.Migrate(db, nil); err == nil {
+		t.Fatal("expected error")
+	} else if err := checkErr(err, "unsupported isolation level: Linearizable"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfig_Migrate_notify(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations", NotifyChannel: "pgmigrate"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	l := pq.NewListener(os.Getenv("PG_DSN"), time.Second, time.Second, nil)
+	defer l.Close()
+	if err := l.Listen(c.NotifyChannel); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2"},
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.Migrate(db, ms); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case n := <-l.Notify:
+		if n.Extra != `{"ids":[1,2]}` {
+			t.Fatalf("got=%q", n.Extra)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for notification")
+	}
+	select {
+	case n := <-l.Notify:
+		t.Fatalf("unexpected notification: %#v", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestConfig_Migrate_splitStatements(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations", SplitStatements: true}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public, foo CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "CREATE SCHEMA foo; CREATE TABLE foo.bar(s text); INSERT INTO foo.bar VALUES ('a;b');"},
+		{ID: 2, Description: "2_fail.sql", SQL: "SELECT 1; SELECT * FROM does_not_exist;"},
+	}
+	if _, err := c.Migrate(db, ms[:1]); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Migrate(db, ms)
+	var execErr *ExecError
+	if err := checkErr(err, "2 2_fail.sql: statement 2:"); err != nil {
+		t.Fatal(err)
+	} else if !errors.As(err, &execErr) || execErr.SQL != "SELECT * FROM does_not_exist" || execErr.Position != 15 {
+		t.Fatalf("unexpected error: %#v", execErr)
+	}
+}
+
+func TestConfig_MigrateResult(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var now time.Time
+	c := Config{Schema: "public", Table: "migrations", Now: func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2"},
+	}
+	got, err := c.MigrateResult(db, ms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Result{{Migration: ms[0], Duration: time.Second}, {Migration: ms[1], Duration: time.Second}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, want)
+	}
+}
+
+func TestConfig_MigrateTo(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2"},
+		{ID: 3, Description: "3_baz.sql", SQL: "SELECT 3"},
+	}
+	_, err = c.MigrateTo(db, ms, 4)
+	if err := checkErr(err, "target id 4 is greater than the highest migration id 3"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.MigrateTo(db, ms, 2); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, ms[:2]) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, ms[:2])
+	}
+	_, err = c.MigrateTo(db, ms, 1)
+	if err := checkErr(err, "target id 1 is less than the highest applied migration id 2"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.MigrateTo(db, ms, 3); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, ms[2:]) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, ms[2:])
+	}
+}
+
+type testMetrics []string
+
+func (t *testMetrics) MigrationApplied(id int64, d time.Duration) {
+	*t = append(*t, fmt.Sprintf("applied %d", id))
+}
+
+func (t *testMetrics) MigrationFailed(id int64, err error) {
+	*t = append(*t, fmt.Sprintf("failed %d", id))
+}
+
+func TestConfig_Migrate_metrics(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := &testMetrics{}
+	c := Config{Schema: "public", Table: "migrations", Metrics: metrics}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_fail.sql", SQL: "SELECT * FROM does_not_exist"},
+	}
+	if _, err := c.Migrate(db, ms); err == nil {
+		t.Fatal("expected error")
+	}
+	if want := (testMetrics{"applied 1", "failed 2"}); !reflect.DeepEqual(*metrics, want) {
+		t.Fatalf("got=%v want=%v", *metrics, want)
+	}
+}
+
+type testTracer []string
+
+func (t *testTracer) StartSpan(name string) func(err error) {
+	*t = append(*t, "start "+name)
+	return func(err error) {
+		*t = append(*t, fmt.Sprintf("finish %s: %v", name, err))
+	}
+}
+
+type testLogger []string
+
+func (t *testLogger) Printf(format string, args ...interface{}) {
+	*t = append(*t, fmt.Sprintf(format, args...))
+}
+
+func TestConfig_Migrate_logger(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := &testLogger{}
+	c := Config{Schema: "public", Table: "migrations", Logger: logger}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"}}
+	if _, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	}
+	ms[0].SQL = "SELECT 2"
+	if _, err := c.Migrate(db, ms); err == nil {
+		t.Fatal("expected error")
+	}
+	want := []string{
+		`initialized migrations table "public"."migrations"`,
+		"applying migration 1 1_foo.sql",
+		"applied migration 1 1_foo.sql in ",
+		`initialized migrations table "public"."migrations"`,
+		"drift detected: modified migration 1 detected",
+	}
+	if len(*logger) != len(want) {
+		t.Fatalf("got=%q want=%q", *logger, want)
+	}
+	for i, line := range *logger {
+		if !strings.HasPrefix(line, want[i]) {
+			t.Fatalf("got=%q want=%q", *logger, want)
+		}
+	}
+}
+
+func TestConfig_ApplyOne(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2"},
+		{ID: 3, Description: "3_hotfix.sql", SQL: "CREATE TABLE public.hotfix();"},
+	}
+	if _, err := c.Migrate(db, ms[:1]); err != nil {
+		t.Fatal(err)
+	} else if err := c.ApplyOne(db, ms[2]); err != nil {
+		t.Fatal(err)
+	} else if err := checkErr(c.ApplyOne(db, ms[2]), "migration 3 has already been applied"); err != nil {
+		t.Fatal(err)
+	}
+	var exists bool
+	if err := db.QueryRow("SELECT to_regclass('public.hotfix') IS NOT NULL").Scan(&exists); err != nil {
+		t.Fatal(err)
+	} else if !exists {
+		t.Fatal("expected hotfix table to be created")
+	}
+	statuses, err := c.Status(db, ms)
+	if err != nil {
+		t.Fatal(err)
+	} else if statuses[1].State != Pending || statuses[2].State != Applied {
+		t.Fatalf("unexpected statuses: %#v", statuses)
+	}
+	if _, err := c.Migrate(db, ms); !errors.Is(err, ErrOutOfOrder) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := c.ApplyOne(db, ms[1]); err != nil {
+		t.Fatal(err)
+	} else if got, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 0 {
+		t.Fatalf("got=%d want=0", len(got))
+	}
+}
+
+func TestConfig_Reapply(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_create_view.sql", SQL: "CREATE OR REPLACE VIEW public.foo AS SELECT 1 AS bar;"},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2"},
+	}
+	if _, err := c.Migrate(db, ms[:1]); err != nil {
+		t.Fatal(err)
+	} else if _, err := db.Exec("DROP VIEW public.foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkErr(c.Reapply(db, ms[1]), "migration 2 has not been applied"); err != nil {
+		t.Fatal(err)
+	}
+	modified := ms[0]
+	modified.SQL = "SELECT 'modified'"
+	if err := c.Reapply(db, modified); !errors.Is(err, ErrModifiedMigration) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.Reapply(db, ms[0]); err != nil {
+		t.Fatal(err)
+	}
+	var bar int
+	if err := db.QueryRow("SELECT bar FROM public.foo").Scan(&bar); err != nil {
+		t.Fatal(err)
+	}
+	if applied, err := c.Applied(db); err != nil {
+		t.Fatal(err)
+	} else if len(applied) != 1 {
+		t.Fatalf("got=%d want=1", len(applied))
+	}
+}
+
+func TestConfig_Pending(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public, foo CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_create_schema.sql", SQL: "CREATE SCHEMA foo;"},
+		{ID: 2, Description: "2_create_table.sql", SQL: "CREATE TABLE foo.bar();"},
+	}
+	if got, err := c.Pending(db, ms); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, ms) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, ms)
+	}
+	if _, err := c.Migrate(db, ms[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.Pending(db, ms); err != nil {
+		t.Fatal(err)
+	} else if want := ms[1:]; !reflect.DeepEqual(got, want) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, want)
+	}
+	modified := Migrations{{ID: 1, Description: "1_create_schema.sql", SQL: "CREATE SCHEMA bar;"}}
+	_, err = c.Pending(db, modified)
+	if err := checkErr(err, "modified migration"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfig_IsUpToDate(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2"},
+	}
+	if ok, err := c.IsUpToDate(db, ms); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("expected missing table to not be up to date")
+	} else if exists, err := c.tableExists(context.Background(), SQLDB(db)); err != nil {
+		t.Fatal(err)
+	} else if exists {
+		t.Fatal("expected migrations table to not be created")
+	}
+	if _, err := c.Migrate(db, ms[:1]); err != nil {
+		t.Fatal(err)
+	} else if ok, err := c.IsUpToDate(db, ms); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("expected pending migration to not be up to date")
+	}
+	if _, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	} else if ok, err := c.IsUpToDate(db, ms); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("expected up to date")
+	} else if got, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	} else if got == nil || len(got) != 0 {
+		t.Fatalf("got=%#v want empty migrations", got)
+	}
+	ms[1].SQL = "SELECT 3"
+	if ok, err := c.IsUpToDate(db, ms); !errors.Is(err, ErrModifiedMigration) || ok {
+		t.Fatalf("unexpected result: ok=%t err=%v", ok, err)
+	}
+}
+
+func TestConfig_Applied(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.Applied(db); err != nil {
+		t.Fatal(err)
+	} else if got == nil || len(got) != 0 {
+		t.Fatalf("got=%#v want=empty list", got)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_sleep.sql", SQL: "SELECT pg_sleep(0.1)"},
+	}
+	start := time.Now()
+	if _, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.Applied(db)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(got) != len(ms) {
+		t.Fatalf("got=%d want=%d", len(got), len(ms))
+	}
+	for i, am := range got {
+		if am.ID != ms[i].ID || am.Description != ms[i].Description {
+			t.Errorf("got=%d %s want=%d %s", am.ID, am.Description, ms[i].ID, ms[i].Description)
+		} else if am.Created.Before(start.Add(-time.Minute)) || am.Created.Location() != time.UTC {
+			t.Errorf("unexpected created: %s", am.Created)
+		}
+	}
+	if got[1].Duration < 100*time.Millisecond {
+		t.Errorf("got=%s want>=100ms", got[1].Duration)
+	}
+	var currentUser string
+	if err := db.QueryRow("SELECT current_user").Scan(&currentUser); err != nil {
+		t.Fatal(err)
+	} else if got[0].AppliedBy != currentUser {
+		t.Errorf("got=%q want=%q", got[0].AppliedBy, currentUser)
+	}
+
+	c.AppliedBy = "deploy-123"
+	ms = append(ms, Migration{ID: 3, Description: "3_baz.sql", SQL: "SELECT 3"})
+	if _, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	} else if got, err = c.Applied(db); err != nil {
+		t.Fatal(err)
+	} else if got[2].AppliedBy != c.AppliedBy {
+		t.Errorf("got=%q want=%q", got[2].AppliedBy, c.AppliedBy)
+	} else if got[0].Revision != "" {
+		t.Errorf("got=%q want=%q", got[0].Revision, "")
+	}
+
+	c.Revision = "3f2a9c1"
+	ms = append(ms, Migration{ID: 4, Description: "4_qux.sql", SQL: "SELECT 4"})
+	if _, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	} else if got, err = c.Applied(db); err != nil {
+		t.Fatal(err)
+	} else if got[3].Revision != c.Revision {
+		t.Errorf("got=%q want=%q", got[3].Revision, c.Revision)
+	}
+}
+
+func TestConfig_Applied_now(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600))
+	c := Config{Schema: "public", Table: "migrations", Now: func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"}}
+	if _, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.Applied(db)
+	if err != nil {
+		t.Fatal(err)
+	} else if want := time.Date(2020, 1, 2, 2, 4, 6, 0, time.UTC); !got[0].Created.Equal(want) || got[0].Created.Location() != time.UTC {
+		t.Errorf("got=%s want=%s", got[0].Created, want)
+	} else if got[0].Duration != time.Second {
+		t.Errorf("got=%s want=%s", got[0].Duration, time.Second)
+	}
+}
+
+func TestConfig_Applied_durationMilliseconds(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations", DurationColumnType: DurationMilliseconds}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{{ID: 1, Description: "1_sleep.sql", SQL: "SELECT pg_sleep(0.1)"}}
+	if _, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		dataType string
+		ms1      int64
+	)
+	if err := db.QueryRow("SELECT data_type FROM information_schema.columns WHERE table_name = 'migrations' AND column_name = 'duration'").Scan(&dataType); err != nil {
+		t.Fatal(err)
+	} else if dataType != "bigint" {
+		t.Fatalf("got=%q want=bigint", dataType)
+	} else if err := db.QueryRow("SELECT duration FROM public.migrations").Scan(&ms1); err != nil {
+		t.Fatal(err)
+	} else if ms1 < 100 {
+		t.Fatalf("got=%d want>=100", ms1)
+	}
+	applied, err := c.Applied(db)
+	if err != nil {
+		t.Fatal(err)
+	} else if applied[0].Duration != time.Duration(ms1)*time.Millisecond {
+		t.Fatalf("got=%s want=%dms", applied[0].Duration, ms1)
+	}
+}
+
+func TestConfig_Version(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.Version(db); err != nil {
+		t.Fatal(err)
+	} else if got != 0 {
+		t.Fatalf("got=%d want=0", got)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2"},
+	}
+	if _, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	} else if got, err := c.Version(db); err != nil {
+		t.Fatal(err)
+	} else if got != 2 {
+		t.Fatalf("got=%d want=2", got)
+	}
+}
+
+func TestConfig_SetVersion(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.StoredSetChecksum(db); err != nil {
+		t.Fatal(err)
+	} else if got != "" {
+		t.Fatalf("got=%q want=%q", got, "")
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2"},
+	}
+	for i := 1; i <= len(ms); i++ {
+		if _, err := c.Migrate(db, ms[:i]); err != nil {
+			t.Fatal(err)
+		} else if err := c.SetVersion(db); err != nil {
+			t.Fatal(err)
+		} else if got, err := c.StoredSetChecksum(db); err != nil {
+			t.Fatal(err)
+		} else if want := ms[:i].SetChecksum(); got != want {
+			t.Fatalf("%d: got=%s want=%s", i, got, want)
+		}
+	}
+}
+
+func TestConfig_Status(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2"},
+		{ID: 3, Description: "3_baz.sql", SQL: "SELECT 3"},
+	}
+	if _, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	}
+	modified := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 'modified'"},
+	}
+	got, err := c.Status(db, modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []MigrationStatus{
+		{ID: 1, Description: "1_foo.sql", State: Applied},
+		{ID: 2, Description: "2_bar.sql", State: Modified},
+		{ID: 3, Description: "3_baz.sql", State: Missing},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, want)
+	}
+	ms = append(ms, Migration{ID: 4, Description: "4_qux.sql", SQL: "SELECT 4"})
+	if got, err := c.Status(db, ms); err != nil {
+		t.Fatal(err)
+	} else if got[3].State != Pending {
+		t.Fatalf("got=%s want=%s", got[3].State, Pending)
+	}
+}
+
+func TestConfig_Diff(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2"},
+		{ID: 3, Description: "3_baz.sql", SQL: "SELECT 3"},
+		{ID: 4, Description: "4_qux.sql", SQL: "SELECT 4"},
+	}
+	if _, err := c.Migrate(db, ms[:3]); err != nil {
+		t.Fatal(err)
+	}
+	changed := Migrations{ms[0], ms[1], ms[3]}
+	changed[0].SQL = "SELECT 'modified'"
+	changed[2].ID = 3
+	changed[2].Description = "3_qux.sql"
+	changed = append(changed, Migration{ID: 4, Description: "4_new.sql", SQL: "SELECT 4"})
+	got, err := c.Diff(db, changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Diff{Modified: []int64{1, 3}, Pending: []int64{4}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, want)
+	}
+	got, err = c.Diff(db, ms[:1])
+	if err != nil {
+		t.Fatal(err)
+	} else if want := (&Diff{Unknown: []int64{2, 3}}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, want)
+	}
+}
+
+func TestConfig_Orphaned(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations", AllowGaps: true}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2"},
+		{ID: 3, Description: "3_baz.sql", SQL: "SELECT 3"},
+	}
+	if got, err := c.Orphaned(db, ms); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 0 {
+		t.Fatalf("got=%#v want=empty list", got)
+	}
+	if _, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.Orphaned(db, Migrations{ms[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Migrations{{ID: 1, Description: "1_foo.sql"}, {ID: 3, Description: "3_baz.sql"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, want)
+	}
+}
+
+func TestConfig_Rollback(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public, foo CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_create_schema.sql", SQL: "CREATE SCHEMA foo;"},
+		{ID: 2, Description: "2_create_table.sql", SQL: "CREATE TABLE foo.bar();", DownSQL: "DROP TABLE foo.bar;"},
+		{ID: 3, Description: "3_create_table.sql", SQL: "CREATE TABLE foo.baz();", DownSQL: "DROP TABLE foo.baz;"},
+	}
+	if _, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Rollback(db, ms, 0)
+	if err := checkErr(err, "missing down sql for migration 1"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.Rollback(db, ms, 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if want := (Migrations{ms[2], ms[1]}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, want)
+	}
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT * FROM information_schema.tables WHERE table_schema = 'foo')").Scan(&exists); err != nil {
+		t.Fatal(err)
+	} else if exists {
+		t.Fatal("expected tables to be dropped")
+	}
+	got, err = c.Migrate(db, ms)
+	if err != nil {
+		t.Fatal(err)
+	} else if want := ms[1:]; !reflect.DeepEqual(got, want) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, want)
+	}
+}
+
+func TestConfig_Rollback_settings(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrate := func(c Config, ms Migrations) {
+		t.Helper()
+		if _, err := db.Exec("DROP SCHEMA IF EXISTS public, foo CASCADE"); err != nil {
+			t.Fatal(err)
+		} else if _, err := c.Migrate(db, ms); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := Config{Schema: "public", Table: "migrations", StatementTimeout: 50 * time.Millisecond}
+	ms := Migrations{{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1", DownSQL: "SELECT pg_sleep(1)"}}
+	migrate(c, ms)
+	_, err = c.Rollback(db, ms, 0)
+	if err := checkErr(err, "canceling statement due to statement timeout"); err != nil {
+		t.Fatal(err)
+	}
+
+	c = Config{Schema: "public", Table: "migrations", StatementLockTimeout: 50 * time.Millisecond}
+	ms = Migrations{{ID: 1, Description: "1_foo.sql", SQL: "CREATE TABLE public.foo();", DownSQL: "DROP TABLE public.foo;"}}
+	migrate(c, ms)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("LOCK TABLE public.foo IN ACCESS EXCLUSIVE MODE"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Rollback(db, ms, 0)
+	if err := checkErr(err, "canceling statement due to lock timeout"); err != nil {
+		t.Fatal(err)
+	} else if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	c = Config{Schema: "public", Table: "migrations", SearchPath: []string{"foo"}}
+	ms = Migrations{{ID: 1, Description: "1_foo.sql", SQL: "CREATE SCHEMA foo; CREATE TABLE foo.bar();", DownSQL: "DROP TABLE bar;"}}
+	migrate(c, ms)
+	if _, err := c.Rollback(db, ms, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	c = Config{Schema: "public", Table: "migrations", SplitStatements: true}
+	ms = Migrations{{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1", DownSQL: "SELECT 1; SELECT * FROM does_not_exist;"}}
+	migrate(c, ms)
+	_, err = c.Rollback(db, ms, 0)
+	if err := checkErr(err, "1 1_foo.sql: statement 2:"); err != nil {
+		t.Fatal(err)
+	}
+
+	c = Config{Schema: "public", Table: "migrations"}
+	ms = Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "CREATE TABLE public.foo (id int);", DownSQL: "DROP TABLE public.foo;"},
+		{ID: 2, Description: "2_bar.sql", SQL: "CREATE INDEX CONCURRENTLY foo_id_idx ON public.foo (id);", DownSQL: "DROP INDEX CONCURRENTLY public.foo_id_idx;", NoTransaction: true},
+	}
+	migrate(c, ms)
+	if got, err := c.Rollback(db, ms, 0); err != nil {
+		t.Fatal(err)
+	} else if want := []int64{2, 1}; !reflect.DeepEqual(got.IDs(), want) {
+		t.Fatalf("got=%v want=%v", got.IDs(), want)
+	} else if version, err := c.Version(db); err != nil {
+		t.Fatal(err)
+	} else if version != 0 {
+		t.Fatalf("got=%d want=0", version)
+	}
+}
+
+func TestConfig_Baseline(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_fail.sql", SQL: "SELECT * FROM does_not_exist"},
+		{ID: 2, Description: "2_fail.sql", SQL: "SELECT * FROM does_not_exist"},
+		{ID: 3, Description: "3_foo.sql", SQL: "SELECT 3"},
+	}
+	if err := checkErr(c.Baseline(db, ms, 4), "unknown baseline migration id 4"); err != nil {
+		t.Fatal(err)
+	} else if err := c.Baseline(db, ms, 2); err != nil {
+		t.Fatal(err)
+	} else if err := checkErr(c.Baseline(db, ms, 2), "cannot baseline: migrations table contains 2 migrations"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.Migrate(db, ms)
+	if err != nil {
+		t.Fatal(err)
+	} else if want := ms[2:]; !reflect.DeepEqual(got, want) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, want)
+	}
+}
+
+func TestConfig_Migrate_matchByHash(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2"},
+		{ID: 3, Description: "3_baz.sql", SQL: "SELECT 3"},
+	}
+	if _, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	}
+	renumbered := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_baz.sql", SQL: "SELECT 3"},
+		{ID: 3, Description: "3_bar.sql", SQL: "SELECT 2"},
+		{ID: 4, Description: "4_qux.sql", SQL: "SELECT 4"},
+	}
+	if _, err := c.Migrate(db, renumbered); !errors.Is(err, ErrModifiedMigration) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c.MatchBy = MatchByHash
+	if got, err := c.Migrate(db, renumbered); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 1 || got[0].ID != 4 {
+		t.Fatalf("unexpected migrations: %#v", got)
+	}
+	c.MatchBy = MatchByID
+	if applied, err := c.Applied(db); err != nil {
+		t.Fatal(err)
+	} else if len(applied) != 4 || applied[1].Description != "2_baz.sql" || applied[2].Description != "3_bar.sql" {
+		t.Fatalf("unexpected migrations: %#v", applied)
+	} else if pending, err := c.Pending(db, renumbered); err != nil {
+		t.Fatal(err)
+	} else if len(pending) != 0 {
+		t.Fatalf("got=%d want=0", len(pending))
+	}
+}
+
+func TestConfig_Migrate_upgradeTable(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logger testLogger
+	c := Config{Schema: "public", Table: "migrations", Logger: &logger}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	oldTable := `CREATE SCHEMA public;
+CREATE TABLE public.migrations (
+  id int NOT NULL,
+  description text NOT NULL,
+  sql text NOT NULL,
+  duration interval NOT NULL,
+  created timestamp without time zone DEFAULT (now() AT TIME ZONE 'UTC') NOT NULL
+);
+INSERT INTO public.migrations (id, description, sql, duration) VALUES (1, '1_foo.sql', 'SELECT 1', '0s');`
+	if _, err := db.Exec(oldTable); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_bar.sql", SQL: "SELECT 2"},
+	}
+	// read only callers must work before Migrate has added the columns
+	if applied, err := c.Applied(db); err != nil {
+		t.Fatal(err)
+	} else if len(applied) != 1 || applied[0].SQL != "SELECT 1" {
+		t.Fatalf("unexpected applied migrations: %#v", applied)
+	} else if ok, err := c.IsUpToDate(db, ms[:1]); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("expected db to be up to date")
+	} else if _, err := c.Status(db, ms); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 1 {
+		t.Fatalf("got=%d want=1", len(got))
+	}
+	for _, name := range []string{"sha256", "applied_by", "revision"} {
+		want := "added column " + name + ` to migrations table "public"."migrations"`
+		if !strings.Contains(strings.Join(logger, "\n"), want) {
+			t.Errorf("missing log line %q in %q", want, logger)
+		}
+	}
+	logger = nil
+	if _, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	} else if strings.Contains(strings.Join(logger, "\n"), "added column") {
+		t.Fatalf("unexpected log lines: %q", logger)
+	}
+}
+
+func TestConfig_Migrate_uniqueID(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	m := Migration{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"}
+	if _, err := c.Migrate(db, Migrations{m}); err != nil {
+		t.Fatal(err)
+	}
+	// Recording m again simulates a concurrent migration that bypassed the
+	// advisory lock.
+	err = c.record(context.Background(), SQLDB(db), m, 0, time.Now())
+	if err := checkErr(err, "migration 1 has already been recorded, possibly by a concurrent migration"); err != nil {
+		t.Fatal(err)
+	}
+	insert := "INSERT INTO " + c.table() + " (id, description, sql, duration) VALUES (1, '1_foo.sql', '', '0s')"
+	if _, err := db.Exec(insert); err == nil {
+		t.Fatal("expected unique violation")
+	}
+}
+
+func TestConfig_Migrate_store(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &testStore{}
+	c := Config{Schema: "public", Table: "migrations", Store: store}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE; CREATE SCHEMA public"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "CREATE TABLE public.foo (id int)"},
+		{ID: 2, Description: "2_bar.sql", SQL: "INSERT INTO public.foo VALUES (1)"},
+	}
+	if got, err := c.Migrate(db, ms[:1]); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 1 {
+		t.Fatalf("got=%d want=1", len(got))
+	} else if got, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 1 {
+		t.Fatalf("got=%d want=1", len(got))
+	} else if len(store.applied) != len(ms) {
+		t.Fatalf("got=%d want=%d", len(store.applied), len(ms))
+	} else if version, err := c.Version(db); err != nil {
+		t.Fatal(err)
+	} else if version != 2 {
+		t.Fatalf("got=%d want=2", version)
+	}
+	var exists bool
+	if err := db.QueryRow("SELECT to_regclass('public.migrations') IS NOT NULL").Scan(&exists); err != nil {
+		t.Fatal(err)
+	} else if exists {
+		t.Fatal("unexpected migrations table")
+	}
+
+	ms[0].SQL = "CREATE TABLE public.bar (id int)"
+	if _, err := c.Migrate(db, ms); !errors.Is(err, ErrModifiedMigration) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ms[0].SQL = store.applied[0].SQL
+	ms = append(ms, Migration{ID: 3, Description: "3_baz.sql", SQL: "SELECT 3"})
+	store.err = errors.New("unavailable")
+	if _, err := c.Migrate(db, ms); err == nil || !strings.Contains(err.Error(), "migration 3 applied, but not recorded in Store: unavailable") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// testStore implements Store in memory.
+type testStore struct {
+	applied []AppliedMigration
+	err     error
+}
+
+// Applied is part of the Store interface.
+func (s *testStore) Applied(ctx context.Context) ([]AppliedMigration, error) {
+	return s.applied, nil
+}
+
+// Record is part of the Store interface.
+func (s *testStore) Record(ctx context.Context, am AppliedMigration) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.applied = append(s.applied, am)
+	return nil
+}
+
+func TestConfig_Migrate_compressSQL(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "SELECT 1"},
+		{ID: 2, Description: "2_bar.sql", SQL: "-- bar\nSELECT 2"},
+	}
+	if _, err := c.Migrate(db, ms[:1]); err != nil {
+		t.Fatal(err)
+	}
+	c.CompressSQL = true
+	if applied, err := c.Applied(db); err != nil {
+		t.Fatalf("expected Applied to work before sql_gzip is added: %s", err)
+	} else if len(applied) != 1 {
+		t.Fatalf("got=%d want=1", len(applied))
+	} else if _, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := c.Applied(db)
+	if err != nil {
+		t.Fatal(err)
+	} else if applied[0].SQL != "" || applied[1].SQL != ms[1].SQL {
+		t.Fatalf("got=%q, %q want=%q, %q", applied[0].SQL, applied[1].SQL, "", ms[1].SQL)
+	}
+	ms[1].SQL = "-- bar\nSELECT 3"
+	_, err = c.Migrate(db, ms)
+	if err := checkErr(err, `modified migration 2 detected (2 applied): line 2 changed from "SELECT 2" to "SELECT 3"`); err != nil {
+		t.Fatal(err)
+	} else if err := c.Repair(db, ms); err != nil {
+		t.Fatal(err)
+	} else if applied, err = c.Applied(db); err != nil {
+		t.Fatal(err)
+	} else if applied[1].SQL != ms[1].SQL {
+		t.Fatalf("got=%q want=%q", applied[1].SQL, ms[1].SQL)
+	}
+}
+
+func TestConfig_Reset(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{{ID: 1, Description: "1_foo.sql", SQL: "CREATE TABLE public.foo()"}}
+	if _, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	} else if err := checkErr(c.Reset(db), "reset is not allowed"); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AllowReset = true
+	for i := 0; i < 2; i++ {
+		if err := c.Reset(db); err != nil {
+			t.Fatal(err)
+		} else if got, err := c.Migrate(db, ms); err != nil {
+			t.Fatal(err)
+		} else if len(got) != 1 {
+			t.Fatalf("got=%d want=1", len(got))
+		}
+	}
+
+	c.SkipCreateSchema = true
+	if err := c.Reset(db); err != nil {
+		t.Fatal(err)
+	} else if version, err := c.Version(db); err != nil {
+		t.Fatal(err)
+	} else if version != 0 {
+		t.Fatalf("got=%d want=0", version)
+	}
+	var exists bool
+	if err := db.QueryRow("SELECT to_regclass('public.foo') IS NOT NULL").Scan(&exists); err != nil {
+		t.Fatal(err)
+	} else if !exists {
+		t.Fatal("expected public.foo to be kept")
+	}
+}
+
+func TestConfig_Repair(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Config{Schema: "public", Table: "migrations"}
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS public, foo CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	ms := Migrations{
+		{ID: 1, Description: "1_create_schema.sql", SQL: "CREATE SCHEMA foo;"},
+		{ID: 2, Description: "2_create_table.sql", SQL: "CREATE TABLE foo.bar();"},
+	}
+	if _, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	}
+	ms[1].SQL = "CREATE TABLE foo.bar ();"
+	if _, err := c.Migrate(db, ms); !errors.Is(err, ErrModifiedMigration) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	renamed := append(Migrations{}, ms...)
+	renamed[1].Description = "2_create_bar.sql"
+	if err := checkErr(c.Repair(db, renamed), "cannot repair migration 2: description mismatch"); err != nil {
+		t.Fatal(err)
+	} else if err := c.Repair(db, ms[:1]); !errors.Is(err, ErrUnknownMigration) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := c.Repair(db, ms); err != nil {
+		t.Fatal(err)
+	}
+	ms = append(ms, Migration{ID: 3, Description: "3_create_table.sql", SQL: "CREATE TABLE foo.baz();"})
+	if got, err := c.Migrate(db, ms); err != nil {
+		t.Fatal(err)
+	} else if want := ms[2:]; !reflect.DeepEqual(got, want) {
+		t.Fatalf("\ngot: %#v\nwant: %#v\n", got, want)
+	}
+}
+
 func checkErr(got error, want string) error {
 	var gotS string
 	if got != nil {
@@ -0,0 +1,49 @@
+// Package pgmigratetest provides helpers for testing code that uses
+// pgmigrate. It's a separate package, so pgmigrate doesn't import testing.
+package pgmigratetest
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"testing"
+
+	"github.com/felixge/pgmigrate"
+)
+
+// TestMigrate applies ms to a new schema with a unique name, which holds the
+// migrations table and is the search_path for executing ms, so unqualified
+// objects created by ms are isolated from other tests. The name of the schema
+// is logged via t. The returned cleanup func drops the schema and everything
+// in it. Errors are reported via t.Fatal.
+func TestMigrate(t testing.TB, db *sql.DB, ms pgmigrate.Migrations) (cleanup func()) {
+	t.Helper()
+	schema, err := schemaName()
+	if err != nil {
+		t.Fatalf("pgmigratetest: %s", err)
+	}
+	cleanup = func() {
+		t.Helper()
+		if _, err := db.Exec(`DROP SCHEMA IF EXISTS "` + schema + `" CASCADE`); err != nil {
+			t.Errorf("pgmigratetest: drop schema %s: %s", schema, err)
+		}
+	}
+	c := pgmigrate.DefaultConfig
+	c.Schema = schema
+	c.SearchPath = []string{schema}
+	if _, err := c.Migrate(db, ms); err != nil {
+		cleanup()
+		t.Fatalf("pgmigratetest: migrate schema %s: %s", schema, err)
+	}
+	t.Logf("pgmigratetest: migrated schema %s", schema)
+	return cleanup
+}
+
+// schemaName returns a random schema name that doesn't need quoting.
+func schemaName() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "pgmigratetest_" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,51 @@
+package pgmigratetest
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/felixge/pgmigrate"
+	_ "github.com/lib/pq"
+)
+
+func TestTestMigrate(t *testing.T) {
+	db, err := sql.Open("postgres", os.Getenv("PG_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := pgmigrate.Migrations{
+		{ID: 1, Description: "1_foo.sql", SQL: "CREATE TABLE foo (id int)"},
+		{ID: 2, Description: "2_bar.sql", SQL: "INSERT INTO foo VALUES (1)"},
+	}
+	cleanup := TestMigrate(t, db, ms)
+	other := TestMigrate(t, db, ms)
+	other()
+
+	var count int
+	query := "SELECT count(*) FROM pg_tables WHERE schemaname LIKE 'pgmigratetest\\_%' AND tablename = 'foo'"
+	if err := db.QueryRow(query).Scan(&count); err != nil {
+		t.Fatal(err)
+	} else if count != 1 {
+		t.Fatalf("got=%d want=1", count)
+	}
+	cleanup()
+	if err := db.QueryRow(query).Scan(&count); err != nil {
+		t.Fatal(err)
+	} else if count != 0 {
+		t.Fatalf("got=%d want=0", count)
+	}
+}
+
+func TestSchemaName(t *testing.T) {
+	a, err := schemaName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := schemaName()
+	if err != nil {
+		t.Fatal(err)
+	} else if a == b {
+		t.Fatalf("duplicate schema name: %s", a)
+	}
+}
@@ -0,0 +1,53 @@
+package pgmigrate
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// retry calls fn until it succeeds, returns an error that is not a connection
+// error, or ConnectRetries is exceeded, and returns the last error.
+func (c *Config) retry(ctx context.Context, fn func() error) error {
+	backoff := c.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt > c.ConnectRetries || !isConnError(err) {
+			return err
+		}
+		c.logger().Printf("connection error, retry %d of %d in %s: %s", attempt, c.ConnectRetries, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// isConnError returns true if err indicates that the connection to the db
+// failed, rather than a query. Postgres errors are detected using the
+// SQLState method implemented by the errors of lib/pq and pgx.
+func isConnError(err error) bool {
+	var (
+		netErr   net.Error
+		stateErr interface{ SQLState() string }
+	)
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	} else if errors.As(err, &netErr) {
+		return true
+	} else if errors.As(err, &stateErr) {
+		// Class 08 are connection exceptions, the 57P0x codes are sent while
+		// the server is shutting down or starting up.
+		state := stateErr.SQLState()
+		return strings.HasPrefix(state, "08") || state == "57P01" || state == "57P02" || state == "57P03"
+	}
+	return false
+}
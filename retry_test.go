@@ -0,0 +1,67 @@
+package pgmigrate
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+type testStateError string
+
+func (e testStateError) Error() string    { return "state " + string(e) }
+func (e testStateError) SQLState() string { return string(e) }
+
+func TestIsConnError(t *testing.T) {
+	tests := []struct {
+		Err  error
+		Want bool
+	}{
+		{errors.New("syntax error"), false},
+		{driver.ErrBadConn, true},
+		{fmt.Errorf("could not acquire migration lock: %w", &net.OpError{Op: "dial", Err: errors.New("connection refused")}), true},
+		{testStateError("08006"), true},
+		{testStateError("57P03"), true},
+		{testStateError("42P01"), false},
+	}
+	for _, test := range tests {
+		if got := isConnError(test.Err); got != test.Want {
+			t.Errorf("%v: got=%t want=%t", test.Err, got, test.Want)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	logger := &testLogger{}
+	c := Config{ConnectRetries: 2, Logger: logger}
+	calls := 0
+	err := c.retry(context.Background(), func() error {
+		calls++
+		return driver.ErrBadConn
+	})
+	if err != driver.ErrBadConn || calls != 3 || len(*logger) != 2 {
+		t.Fatalf("err=%v calls=%d logs=%q", err, calls, *logger)
+	}
+
+	calls = 0
+	err = c.retry(context.Background(), func() error {
+		calls++
+		return testStateError("42P01")
+	})
+	if err == nil || calls != 1 {
+		t.Fatalf("err=%v calls=%d", err, calls)
+	}
+
+	calls = 0
+	err = c.retry(context.Background(), func() error {
+		if calls++; calls == 1 {
+			return driver.ErrBadConn
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Fatalf("err=%v calls=%d", err, calls)
+	}
+}
@@ -0,0 +1,142 @@
+package pgmigrate
+
+import (
+	"strings"
+)
+
+// splitStatements splits sql into the individual statements separated by
+// semicolons, and removes statements that only contain whitespace and
+// comments, e.g. because of duplicate or trailing semicolons. Semicolons
+// inside of string literals, quoted identifiers, dollar-quoted strings (e.g.
+// $$ ... $$ or $body$ ... $body$) and comments are not treated as statement
+// separators. Unterminated quotes or comments extend to the end of sql.
+func splitStatements(sql string) []string {
+	var (
+		stmts []string
+		start int
+	)
+	for i := 0; i < len(sql); {
+		switch {
+		case sql[i] == ';':
+			stmts = appendStatement(stmts, sql[start:i])
+			i++
+			start = i
+		case sql[i] == '\'':
+			escapes := i > 0 && (sql[i-1] == 'E' || sql[i-1] == 'e') && (i == 1 || !isIdentChar(sql[i-2]))
+			i = skipQuoted(sql, i, '\'', escapes)
+		case sql[i] == '"':
+			i = skipQuoted(sql, i, '"', false)
+		case strings.HasPrefix(sql[i:], "--"):
+			if end := strings.IndexByte(sql[i:], '\n'); end == -1 {
+				i = len(sql)
+			} else {
+				i += end + 1
+			}
+		case strings.HasPrefix(sql[i:], "/*"):
+			i = skipBlockComment(sql, i)
+		case sql[i] == '$' && (i == 0 || !isIdentChar(sql[i-1])):
+			i = skipDollarQuoted(sql, i)
+		default:
+			i++
+		}
+	}
+	return appendStatement(stmts, sql[start:])
+}
+
+// hasEffectiveSQL returns true if sql contains anything other than whitespace,
+// comments and semicolons.
+func hasEffectiveSQL(sql string) bool {
+	for i := 0; i < len(sql); {
+		switch {
+		case sql[i] == ';' || sql[i] == ' ' || sql[i] == '\t' || sql[i] == '\n' || sql[i] == '\r' || sql[i] == '\f':
+			i++
+		case strings.HasPrefix(sql[i:], "--"):
+			if end := strings.IndexByte(sql[i:], '\n'); end == -1 {
+				i = len(sql)
+			} else {
+				i += end + 1
+			}
+		case strings.HasPrefix(sql[i:], "/*"):
+			i = skipBlockComment(sql, i)
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// appendStatement appends the trimmed stmt to stmts, unless it only contains
+// whitespace and comments, which some drivers fail to execute.
+func appendStatement(stmts []string, stmt string) []string {
+	if stmt = strings.TrimSpace(stmt); hasEffectiveSQL(stmt) {
+		stmts = append(stmts, stmt)
+	}
+	return stmts
+}
+
+// skipQuoted returns the position after the quoted string or identifier
+// starting at sql[i]. Quotes are escaped by doubling them, or using a
+// backslash if escapes is true.
+func skipQuoted(sql string, i int, quote byte, escapes bool) int {
+	for i++; i < len(sql); i++ {
+		if escapes && sql[i] == '\\' {
+			i++
+		} else if sql[i] == quote {
+			if i+1 < len(sql) && sql[i+1] == quote {
+				i++
+			} else {
+				return i + 1
+			}
+		}
+	}
+	return len(sql)
+}
+
+// skipBlockComment returns the position after the possibly nested block
+// comment starting at sql[i].
+func skipBlockComment(sql string, i int) int {
+	depth := 0
+	for i < len(sql) {
+		if strings.HasPrefix(sql[i:], "/*") {
+			depth++
+			i += 2
+		} else if strings.HasPrefix(sql[i:], "*/") {
+			depth--
+			i += 2
+			if depth == 0 {
+				return i
+			}
+		} else {
+			i++
+		}
+	}
+	return len(sql)
+}
+
+// skipDollarQuoted returns the position after the dollar-quoted string
+// starting at sql[i], or i+1 if sql[i] does not start a dollar quote, e.g.
+// because it's a positional parameter such as $1.
+func skipDollarQuoted(sql string, i int) int {
+	end := i + 1
+	for end < len(sql) && sql[end] != '$' && isIdentChar(sql[end]) && !(end == i+1 && isDigit(sql[end])) {
+		end++
+	}
+	if end >= len(sql) || sql[end] != '$' {
+		return i + 1
+	}
+	tag := sql[i : end+1]
+	if closing := strings.Index(sql[end+1:], tag); closing != -1 {
+		return end + 1 + closing + len(tag)
+	}
+	return len(sql)
+}
+
+// isIdentChar returns true if c may be part of an unquoted identifier.
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+// isDigit returns true if c is an ASCII digit.
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
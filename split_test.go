@@ -0,0 +1,83 @@
+package pgmigrate
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		SQL  string
+		Want []string
+	}{
+		{"", nil},
+		{"SELECT 1", []string{"SELECT 1"}},
+		{"SELECT 1; SELECT 2;\n", []string{"SELECT 1", "SELECT 2"}},
+		{"SELECT 'a;b'; SELECT 'it''s;'", []string{"SELECT 'a;b'", "SELECT 'it''s;'"}},
+		{`SELECT E'a\';b'; SELECT 2`, []string{`SELECT E'a\';b'`, "SELECT 2"}},
+		{`SELECT 'a\'; SELECT 2`, []string{`SELECT 'a\'`, "SELECT 2"}},
+		{`SELECT 1 AS "a;b"; SELECT 2`, []string{`SELECT 1 AS "a;b"`, "SELECT 2"}},
+		{"SELECT 1; -- a; b\nSELECT 2", []string{"SELECT 1", "-- a; b\nSELECT 2"}},
+		{"SELECT /* a; /* b; */ c; */ 1; SELECT 2", []string{"SELECT /* a; /* b; */ c; */ 1", "SELECT 2"}},
+		{"SELECT $$a;b$$; SELECT 2", []string{"SELECT $$a;b$$", "SELECT 2"}},
+		{"SELECT $func$a;$$;b$func$; SELECT 2", []string{"SELECT $func$a;$$;b$func$", "SELECT 2"}},
+		{"PREPARE foo AS SELECT $1; SELECT 2", []string{"PREPARE foo AS SELECT $1", "SELECT 2"}},
+		{"SELECT 'unterminated; SELECT 2", []string{"SELECT 'unterminated; SELECT 2"}},
+		{"SELECT 1;;", []string{"SELECT 1"}},
+		{"SELECT 1;\n;\n", []string{"SELECT 1"}},
+		{";; ;", nil},
+		{"SELECT 1; -- done\n", []string{"SELECT 1"}},
+		{"SELECT 1; /* done; */", []string{"SELECT 1"}},
+		{"SELECT 1;\n\n\t\nSELECT 2;\n\n", []string{"SELECT 1", "SELECT 2"}},
+	}
+	for _, test := range tests {
+		got := splitStatements(test.SQL)
+		if !reflect.DeepEqual(got, test.Want) {
+			t.Errorf("%q:\ngot: %q\nwant: %q", test.SQL, got, test.Want)
+		}
+	}
+}
+
+func TestSplitStatements_functions(t *testing.T) {
+	function := `CREATE FUNCTION set_updated() RETURNS trigger AS $body$
+BEGIN
+	IF NEW.updated IS NULL THEN
+		NEW.updated := now();
+	END IF;
+	PERFORM 'not; a $$ quote';
+	EXECUTE $$SELECT 1; SELECT 2$$;
+	RETURN NEW;
+END;
+$body$ LANGUAGE plpgsql`
+	trigger := "CREATE TRIGGER foo_updated BEFORE UPDATE ON foo FOR EACH ROW EXECUTE PROCEDURE set_updated()"
+	other := `CREATE FUNCTION one() RETURNS int AS $$
+BEGIN
+	RETURN 1;
+END;
+$$ LANGUAGE plpgsql`
+	sql := "CREATE TABLE foo (updated timestamp);\n" + function + ";\n" + trigger + ";\n" + other + ";\n"
+	want := []string{"CREATE TABLE foo (updated timestamp)", function, trigger, other}
+	if got := splitStatements(sql); !reflect.DeepEqual(got, want) {
+		t.Fatalf("\ngot: %q\nwant: %q", got, want)
+	}
+}
+
+func TestHasEffectiveSQL(t *testing.T) {
+	tests := []struct {
+		SQL  string
+		Want bool
+	}{
+		{"", false},
+		{" \t\r\n", false},
+		{"-- comment", false},
+		{"-- comment\n/* block /* nested */ */ ;\n", false},
+		{"SELECT 1", true},
+		{"-- comment\nSELECT 1", true},
+		{"/* unterminated SELECT 1", false},
+	}
+	for _, test := range tests {
+		if got := hasEffectiveSQL(test.SQL); got != test.Want {
+			t.Errorf("%q: got=%t want=%t", test.SQL, got, test.Want)
+		}
+	}
+}